@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const accessRecordKey contextKey = "accessRecord"
+
+const (
+	accessLogFormatJSON     = "json"
+	accessLogFormatCommon   = "common"
+	accessLogFormatCombined = "combined"
+
+	accessLogOutputStdout = "stdout"
+	accessLogOutputFile   = "file"
+	accessLogOutputSyslog = "syslog"
+
+	clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+)
+
+// accessLogFields are the fields the JSON format can write, in the order they
+// are listed when no fields are configured
+var accessLogFields = []string{
+	"time", "request_id", "service", "client_ip", "method", "path", "status",
+	"bytes_in", "bytes_out", "upstream", "upstream_latency_ms", "latency_ms",
+	"user", "quota", "user_agent", "referer",
+}
+
+// AccessLogConfig enables one line per request. Successful responses (status
+// below 400) can be sampled; errors are always logged. Query strings are never
+// logged, as OIDC callbacks carry authorization codes in them.
+type AccessLogConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Format  string   `yaml:"format"` // json (default), common or combined
+	Fields  []string `yaml:"fields"` // json only, defaults to every field
+	Output  string   `yaml:"output"` // stdout (default), file or syslog
+	// SuccessSampleRate is the fraction of successful requests logged, 0 to 1
+	// (default 1)
+	SuccessSampleRate *float64 `yaml:"successSampleRate"`
+
+	Path       string `yaml:"path"`       // file output
+	MaxSizeMB  int64  `yaml:"maxSizeMB"`  // rotate the file at this size, default 100
+	MaxBackups int    `yaml:"maxBackups"` // rotated files kept, default 5
+
+	SyslogNetwork string `yaml:"syslogNetwork"` // "" for the local syslog daemon, or udp/tcp
+	SyslogAddress string `yaml:"syslogAddress"`
+	SyslogTag     string `yaml:"syslogTag"` // default "hexgate"
+}
+
+// accessRecord collects what the inner middlewares learn about a request, so
+// the access log written by the outermost one can include it
+type accessRecord struct {
+	service         string
+	requestID       string
+	user            string
+	upstream        string
+	upstreamLatency time.Duration
+	quota           string // allowed, rejected, would-reject, fail-open or fail-closed
+}
+
+func accessRecordFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(accessRecordKey).(*accessRecord)
+	return rec
+}
+
+// setQuota records the quota decision; rec may be nil when access logs are off
+func (rec *accessRecord) setQuota(decision string) {
+	if rec != nil {
+		rec.quota = decision
+	}
+}
+
+type accessLogger struct {
+	format     string
+	fields     []string
+	sampleRate float64
+	ips        *ipResolver
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func newAccessLogger(cfg AccessLogConfig, ips *ipResolver) (*accessLogger, error) {
+	l := &accessLogger{format: cfg.Format, fields: cfg.Fields, sampleRate: 1, ips: ips}
+	switch l.format {
+	case "":
+		l.format = accessLogFormatJSON
+	case accessLogFormatJSON, accessLogFormatCommon, accessLogFormatCombined:
+	default:
+		return nil, fmt.Errorf("unknown format '%s'", cfg.Format)
+	}
+	if len(l.fields) == 0 {
+		l.fields = accessLogFields
+	}
+	for _, field := range l.fields {
+		if !slices.Contains(accessLogFields, field) {
+			return nil, fmt.Errorf("unknown field '%s'", field)
+		}
+	}
+	if cfg.SuccessSampleRate != nil {
+		l.sampleRate = *cfg.SuccessSampleRate
+		if l.sampleRate < 0 || l.sampleRate > 1 {
+			return nil, fmt.Errorf("successSampleRate must be between 0 and 1")
+		}
+	}
+
+	switch cfg.Output {
+	case "", accessLogOutputStdout:
+		l.out = os.Stdout
+	case accessLogOutputFile:
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("file output needs a path")
+		}
+		maxSize := cfg.MaxSizeMB
+		if maxSize <= 0 {
+			maxSize = 100
+		}
+		maxBackups := cfg.MaxBackups
+		if maxBackups <= 0 {
+			maxBackups = 5
+		}
+		f, err := openRotatingFile(cfg.Path, maxSize<<20, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	case accessLogOutputSyslog:
+		tag := cfg.SyslogTag
+		if tag == "" {
+			tag = "hexgate"
+		}
+		w, err := syslog.Dial(cfg.SyslogNetwork, cfg.SyslogAddress, syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		l.out = w
+	default:
+		return nil, fmt.Errorf("unknown output '%s'", cfg.Output)
+	}
+	return l, nil
+}
+
+// accessLogWriter counts the bytes of the response and captures its status
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (aw *accessLogWriter) WriteHeader(code int) {
+	if aw.status == 0 {
+		aw.status = code
+	}
+	aw.ResponseWriter.WriteHeader(code)
+}
+
+func (aw *accessLogWriter) Write(b []byte) (int, error) {
+	if aw.status == 0 {
+		aw.status = http.StatusOK
+	}
+	n, err := aw.ResponseWriter.Write(b)
+	aw.bytes += int64(n)
+	return n, err
+}
+
+func (aw *accessLogWriter) Unwrap() http.ResponseWriter {
+	return aw.ResponseWriter
+}
+
+// countingBody counts the bytes of the request body read by the handlers
+type countingBody struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.bytes += int64(n)
+	return n, err
+}
+
+// accessLogMiddleware wraps the whole gateway, so requests rejected before
+// routing (per-IP limits, unknown paths) are logged too
+func accessLogMiddleware(next http.Handler, l *accessLogger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &accessRecord{}
+		aw := &accessLogWriter{ResponseWriter: w}
+		var body *countingBody
+		if r.Body != nil && r.Body != http.NoBody {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		next.ServeHTTP(aw, r.WithContext(context.WithValue(r.Context(), accessRecordKey, rec)))
+
+		if aw.status == 0 {
+			aw.status = http.StatusOK
+		}
+		if aw.status < http.StatusBadRequest && l.sampleRate < 1 && rand.Float64() >= l.sampleRate {
+			return
+		}
+		var bytesIn int64
+		if body != nil {
+			bytesIn = body.bytes
+		}
+		l.write(l.line(r, rec, aw.status, bytesIn, aw.bytes, start))
+	})
+}
+
+func (l *accessLogger) line(r *http.Request, rec *accessRecord, status int, bytesIn, bytesOut int64, start time.Time) []byte {
+	if l.format != accessLogFormatJSON {
+		return l.formatCLF(r, rec, status, bytesOut, start)
+	}
+
+	entry := make(map[string]interface{}, len(l.fields))
+	for _, field := range l.fields {
+		switch field {
+		case "time":
+			entry[field] = start.Format(time.RFC3339Nano)
+		case "request_id":
+			entry[field] = rec.requestID
+		case "service":
+			entry[field] = rec.service
+		case "client_ip":
+			entry[field] = l.ips.clientIP(r)
+		case "method":
+			entry[field] = r.Method
+		case "path":
+			entry[field] = r.URL.Path
+		case "status":
+			entry[field] = status
+		case "bytes_in":
+			entry[field] = bytesIn
+		case "bytes_out":
+			entry[field] = bytesOut
+		case "upstream":
+			entry[field] = rec.upstream
+		case "upstream_latency_ms":
+			entry[field] = float64(rec.upstreamLatency.Microseconds()) / 1000
+		case "latency_ms":
+			entry[field] = float64(time.Since(start).Microseconds()) / 1000
+		case "user":
+			entry[field] = rec.user
+		case "quota":
+			entry[field] = rec.quota
+		case "user_agent":
+			entry[field] = r.UserAgent()
+		case "referer":
+			entry[field] = r.Referer()
+		}
+	}
+	line, _ := json.Marshal(entry)
+	return append(line, '\n')
+}
+
+// formatCLF writes the Common or Combined Log Format; the authenticated user
+// stands in for the remote user
+func (l *accessLogger) formatCLF(r *http.Request, rec *accessRecord, status int, bytesOut int64, start time.Time) []byte {
+	var b strings.Builder
+	b.WriteString(l.ips.clientIP(r))
+	b.WriteString(" - ")
+	b.WriteString(orDash(rec.user))
+	b.WriteString(" [" + start.Format(clfTimeFormat) + "] ")
+	b.WriteString(strconv.Quote(r.Method + " " + r.URL.Path + " " + r.Proto))
+	b.WriteString(" " + strconv.Itoa(status) + " ")
+	if bytesOut > 0 {
+		b.WriteString(strconv.FormatInt(bytesOut, 10))
+	} else {
+		b.WriteString("-")
+	}
+	if l.format == accessLogFormatCombined {
+		b.WriteString(" " + strconv.Quote(orDash(r.Referer())))
+		b.WriteString(" " + strconv.Quote(orDash(r.UserAgent())))
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (l *accessLogger) write(line []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(line)
+}
+
+// rotatingFile appends to path and, once it grows past maxSize, renames it to
+// path.1 (shifting older files up to path.<maxBackups>) and starts a new one
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// Write is not safe for concurrent use; accessLogger serializes writes
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	// The old handle is of no use either way, so always go on to reopen
+	if err := rf.f.Close(); err != nil {
+		slog.Warn("Failed to close access log file", "path", rf.path, "error", err)
+	}
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("Failed to shift access log backup", "path", rf.path, "backup", i, "error", err)
+		}
+	}
+	// Keep appending to the current file if it cannot be moved aside, and only
+	// try again once it has grown by another maxSize
+	renameErr := os.Rename(rf.path, rf.path+".1")
+	if err := rf.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		slog.Warn("Failed to rotate access log file", "path", rf.path, "error", renameErr)
+		rf.size = 0
+	}
+	return nil
+}
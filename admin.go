@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// defaultRevocationTTL bounds how long a token revocation is kept when the
+// caller does not know the token's expiry
+const defaultRevocationTTL = 24 * time.Hour
+
+type AdminConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Port    string `yaml:"port"`
+	Token   string `yaml:"token"` // bearer token required by every admin endpoint
+}
+
+// newAdminRouter builds the handler for the admin listener. It is never exposed
+// on the gateway port.
+func newAdminRouter(cfg AdminConfig, revocations *revocationList, router *atomic.Value) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /admin/revocations/tokens", revokeTokenHandler(revocations))
+	mux.HandleFunc("GET /admin/revocations/subjects", listRevokedSubjectsHandler(revocations))
+	mux.HandleFunc("POST /admin/revocations/subjects", revokeSubjectHandler(revocations))
+	mux.HandleFunc("DELETE /admin/revocations/subjects/{sub}", unrevokeSubjectHandler(revocations))
+	mux.HandleFunc("GET /admin/quotas/{service}/usage", quotaUsageHandler(router))
+	mux.HandleFunc("POST /admin/quotas/{service}/reset", quotaResetHandler(router))
+	mux.HandleFunc("POST /admin/quotas/{service}/bonus", quotaBonusHandler(router))
+	mux.HandleFunc("POST /admin/quotas/{service}/refund", quotaRefundHandler(router))
+	mux.HandleFunc("GET /admin/quotas/{service}/top", quotaTopHandler(router))
+	return adminAuthMiddleware(mux, cfg.Token)
+}
+
+func adminAuthMiddleware(next http.Handler, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(presented), []byte(token)) != 1 {
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write admin response", "error", err)
+	}
+}
+
+func revokeTokenHandler(revocations *revocationList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			JTI string `json:"jti"`
+			Exp int64  `json:"exp"` // token expiry (unix seconds), optional
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.JTI == "" {
+			http.Error(w, "400 Bad Request: expected {\"jti\": ..., \"exp\": ...}", http.StatusBadRequest)
+			return
+		}
+
+		expiresAt := time.Now().Add(defaultRevocationTTL)
+		if req.Exp > 0 {
+			expiresAt = time.Unix(req.Exp, 0)
+		}
+		if err := revocations.RevokeToken(r.Context(), req.JTI, expiresAt); err != nil {
+			slog.Error("Failed to revoke token", "jti", req.JTI, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Revoked token", "jti", req.JTI, "until", expiresAt.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"jti": req.JTI, "exp": expiresAt.Unix()})
+	}
+}
+
+func revokeSubjectHandler(revocations *revocationList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Subject       string `json:"sub"`
+			RevokedBefore int64  `json:"revokedBefore"` // unix seconds, defaults to now
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Subject == "" {
+			http.Error(w, "400 Bad Request: expected {\"sub\": ..., \"revokedBefore\": ...}", http.StatusBadRequest)
+			return
+		}
+
+		before := time.Now()
+		if req.RevokedBefore > 0 {
+			before = time.Unix(req.RevokedBefore, 0)
+		}
+		if err := revocations.RevokeSubject(r.Context(), req.Subject, before); err != nil {
+			slog.Error("Failed to revoke subject", "sub", req.Subject, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Revoked tokens of subject", "sub", req.Subject, "issued_before", before.Format(time.RFC3339))
+		writeJSON(w, http.StatusOK, map[string]interface{}{"sub": req.Subject, "revokedBefore": before.Unix()})
+	}
+}
+
+func unrevokeSubjectHandler(revocations *revocationList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := r.PathValue("sub")
+		if err := revocations.RevokeSubject(r.Context(), subject, time.Time{}); err != nil {
+			slog.Error("Failed to lift revocation of subject", "sub", subject, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Lifted revocation of subject", "sub", subject)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func listRevokedSubjectsHandler(revocations *revocationList) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, revocations.RevokedSubjects())
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"time"
+)
+
+// Redis layout shared with cmd/hexgatectl:
+//
+//	apikey:<sha256(secret)> -> JSON encoded APIKey
+//	apikeys                 -> HASH of key ID -> sha256(secret)
+const (
+	apiKeyPrefix   = "apikey:"
+	apiKeyIndexKey = "apikeys"
+)
+
+const defaultAPIKeyHeader = "X-API-Key"
+
+type APIKeyConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Header  string `yaml:"header"`
+}
+
+// APIKey is the record stored in Redis for an issued key. The secret itself is
+// never stored, only its SHA-256 hash.
+type APIKey struct {
+	ID        string            `json:"id"`
+	Subject   string            `json:"sub"`
+	Name      string            `json:"name,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey returns the key record for a secret, or nil if it is unknown or expired
+func lookupAPIKey(ctx context.Context, rdb redis.UniversalClient, secret string) (*APIKey, error) {
+	data, err := rdb.Get(ctx, apiKeyPrefix+sha256Hex(secret)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch API key: %w", err)
+	}
+
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, fmt.Errorf("failed to decode API key record: %w", err)
+	}
+	if key.ExpiresAt != nil && time.Now().After(*key.ExpiresAt) {
+		return nil, nil
+	}
+	return &key, nil
+}
+
+// apiKeyAuthMiddleware authenticates requests carrying an API key header.
+// Requests without the header are handed to fallback (usually the JWT middleware).
+func apiKeyAuthMiddleware(next, fallback http.Handler, cfg APIKeyConfig, rdb redis.UniversalClient) http.Handler {
+	header := cfg.Header
+	if header == "" {
+		header = defaultAPIKeyHeader
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := r.Header.Get(header)
+		if secret == "" {
+			fallback.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := lookupAPIKey(r.Context(), rdb, secret)
+		if err != nil {
+			loggerFrom(r.Context()).Error("API key lookup failed", "error", err)
+			httpError(w, r, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if key == nil {
+			httpError(w, r, "401 Unauthorized: Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := withIdentity(r.Context(), &Identity{Subject: key.Subject, Source: "apikey", Metadata: key.Metadata, KeyID: key.ID})
+		loggerFrom(r.Context()).Debug("API key authenticated", "key_id", key.ID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// redisBreaker guards the Redis calls made on the request path, so an outage
+// costs a few timeouts instead of one per request
+var redisBreaker = newCircuitBreaker("redis", 5, 10*time.Second)
+
+// circuitBreaker opens after failureThreshold consecutive failures. Once the
+// cooldown has passed a single probe call is let through (half-open); its
+// outcome closes the circuit again or restarts the cooldown.
+type circuitBreaker struct {
+	name             string
+	failureThreshold int
+	cooldown         time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newCircuitBreaker(name string, failureThreshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, failureThreshold: failureThreshold, cooldown: cooldown}
+}
+
+// Allow reports whether a call may be attempted. Every allowed call must be
+// followed by Record.
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// Record reports the outcome of an allowed call
+func (b *circuitBreaker) Record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	if errors.Is(err, context.Canceled) {
+		// The caller went away, that says nothing about the dependency
+		return
+	}
+	if err == nil {
+		b.failures = 0
+		if b.state != breakerClosed {
+			slog.Info("Circuit breaker closed, dependency is reachable again", "breaker", b.name)
+			b.setState(breakerClosed)
+		}
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.failureThreshold) {
+		slog.Warn("Circuit breaker opened", "breaker", b.name, "failures", b.failures, "error", err)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// Closed reports whether calls are flowing normally. Optional lookups use it to
+// skip Redis entirely while the circuit is not closed.
+func (b *circuitBreaker) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state == breakerClosed
+}
+
+func (b *circuitBreaker) setState(state int) {
+	b.state = state
+	circuitBreakerState.WithLabelValues(b.name).Set(float64(state))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ipResolver finds the real client address of a request. X-Forwarded-For is
+// only honoured for hops added by trusted proxies (e.g. the nginx load balancer),
+// so clients cannot spoof their address by sending the header themselves.
+type ipResolver struct {
+	trusted []*net.IPNet
+}
+
+func newIPResolver(cidrs []string) (*ipResolver, error) {
+	trusted, err := parseCIDRs(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+	}
+	return &ipResolver{trusted: trusted}, nil
+}
+
+// parseCIDRs parses a list of CIDRs; plain addresses are taken as single hosts
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %w", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func (res *ipResolver) isTrusted(ip net.IP) bool {
+	for _, network := range res.trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP walks X-Forwarded-For from the right, skipping trusted proxies, and
+// returns the first address that was not added by one of them
+func (res *ipResolver) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !res.isTrusted(remote) {
+		return host
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	client := host
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !res.isTrusted(ip) {
+			break
+		}
+	}
+	return client
+}
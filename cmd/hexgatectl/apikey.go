@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// The layout below must match apikey.go in the gateway
+const (
+	apiKeyPrefix   = "apikey:"
+	apiKeyIndexKey = "apikeys"
+)
+
+type APIKey struct {
+	ID        string            `json:"id"`
+	Subject   string            `json:"sub"`
+	Name      string            `json:"name,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+}
+
+func hashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func runAPIKey(args []string) error {
+	if len(args) == 0 {
+		return errors.New("expected a subcommand: create, list, revoke or prune")
+	}
+
+	switch args[0] {
+	case "create":
+		return runAPIKeyCreate(args[1:])
+	case "list":
+		return runAPIKeyList(args[1:])
+	case "revoke":
+		return runAPIKeyRevoke(args[1:])
+	case "prune":
+		return runAPIKeyPrune(args[1:])
+	default:
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+}
+
+func runAPIKeyCreate(args []string) error {
+	fs := flag.NewFlagSet("apikey create", flag.ExitOnError)
+	rf := addRedisFlags(fs)
+	subject := fs.String("sub", "", "Subject (user ID) the key authenticates as")
+	name := fs.String("name", "", "Human readable name of the key")
+	ttl := fs.Duration("ttl", 0, "Key lifetime; 0 means the key never expires")
+	metadata := kvFlag{}
+	fs.Var(metadata, "meta", "Metadata as key=value (repeatable), e.g. plan=pro")
+	fs.Parse(args)
+
+	if *subject == "" {
+		return errors.New("-sub is required")
+	}
+
+	secret, err := randomString(24)
+	if err != nil {
+		return err
+	}
+	id, err := randomHex(4)
+	if err != nil {
+		return err
+	}
+	secret = "hg_" + secret
+
+	key := APIKey{
+		ID:        "key_" + id,
+		Subject:   *subject,
+		Name:      *name,
+		Metadata:  metadata,
+		CreatedAt: time.Now().UTC(),
+	}
+	if *ttl > 0 {
+		expiresAt := key.CreatedAt.Add(*ttl)
+		key.ExpiresAt = &expiresAt
+	}
+	if len(key.Metadata) == 0 {
+		key.Metadata = nil
+	}
+
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	rdb, err := rf.client()
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+
+	hash := hashAPIKey(secret)
+	// The record and the index live in different cluster slots, so this cannot
+	// be a transaction. The record goes first: an index entry without a record
+	// is only a dangling entry for prune.
+	pipe := rdb.Pipeline()
+	pipe.Set(ctx, apiKeyPrefix+hash, data, *ttl)
+	pipe.HSet(ctx, apiKeyIndexKey, key.ID, hash)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to store API key: %w", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Created API key %s for %s. The secret is shown only once:\n", key.ID, key.Subject)
+	fmt.Println(secret)
+	return nil
+}
+
+func runAPIKeyList(args []string) error {
+	fs := flag.NewFlagSet("apikey list", flag.ExitOnError)
+	rf := addRedisFlags(fs)
+	subject := fs.String("sub", "", "Only list keys of this subject")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	rdb, err := rf.client()
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+
+	index, err := rdb.HGetAll(ctx, apiKeyIndexKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read API key index: %w", err)
+	}
+
+	keys := make([]APIKey, 0, len(index))
+	var dangling []string
+	for id, hash := range index {
+		data, err := rdb.Get(ctx, apiKeyPrefix+hash).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// The record expired; listing never writes, prune cleans these up
+			dangling = append(dangling, id)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read API key %s: %w", id, err)
+		}
+
+		var key APIKey
+		if err := json.Unmarshal(data, &key); err != nil {
+			return fmt.Errorf("failed to decode API key %s: %w", id, err)
+		}
+		if *subject == "" || key.Subject == *subject {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSUBJECT\tNAME\tCREATED\tEXPIRES\tMETADATA")
+	for _, key := range keys {
+		expires := "never"
+		if key.ExpiresAt != nil {
+			expires = key.ExpiresAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", key.ID, key.Subject, key.Name,
+			key.CreatedAt.Format(time.RFC3339), expires, kvFlag(key.Metadata))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if len(dangling) > 0 {
+		sort.Strings(dangling)
+		fmt.Fprintf(os.Stderr, "%d index entries point to expired keys, run 'hexgatectl apikey prune' to remove them: %s\n",
+			len(dangling), strings.Join(dangling, ", "))
+	}
+	return nil
+}
+
+// runAPIKeyPrune removes index entries whose key record has expired
+func runAPIKeyPrune(args []string) error {
+	fs := flag.NewFlagSet("apikey prune", flag.ExitOnError)
+	rf := addRedisFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "Only print the entries that would be removed")
+	fs.Parse(args)
+
+	ctx := context.Background()
+	rdb, err := rf.client()
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+
+	index, err := rdb.HGetAll(ctx, apiKeyIndexKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read API key index: %w", err)
+	}
+
+	var pruned int
+	for id, hash := range index {
+		exists, err := rdb.Exists(ctx, apiKeyPrefix+hash).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read API key %s: %w", id, err)
+		}
+		if exists > 0 {
+			continue
+		}
+		if !*dryRun {
+			// Only drop the entry if it still points to the expired record
+			if err := hdelIfEqual.Run(ctx, rdb, []string{apiKeyIndexKey}, id, hash).Err(); err != nil {
+				return fmt.Errorf("failed to prune API key %s: %w", id, err)
+			}
+		}
+		fmt.Println(id)
+		pruned++
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "Would prune %d index entries\n", pruned)
+	} else {
+		fmt.Fprintf(os.Stderr, "Pruned %d index entries\n", pruned)
+	}
+	return nil
+}
+
+// hdelIfEqual deletes a hash field only if it still has the given value
+var hdelIfEqual = redis.NewScript(`
+if redis.call('HGET', KEYS[1], ARGV[1]) == ARGV[2] then
+  return redis.call('HDEL', KEYS[1], ARGV[1])
+end
+return 0
+`)
+
+func runAPIKeyRevoke(args []string) error {
+	fs := flag.NewFlagSet("apikey revoke", flag.ExitOnError)
+	rf := addRedisFlags(fs)
+	id := fs.String("id", "", "ID of the key to revoke")
+	fs.Parse(args)
+
+	if *id == "" {
+		return errors.New("-id is required")
+	}
+
+	ctx := context.Background()
+	rdb, err := rf.client()
+	if err != nil {
+		return err
+	}
+	defer rdb.Close()
+
+	hash, err := rdb.HGet(ctx, apiKeyIndexKey, *id).Result()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("API key %s not found", *id)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read API key index: %w", err)
+	}
+
+	// Different cluster slots, see create; the record goes first so the key stops
+	// working even if removing the index entry fails
+	pipe := rdb.Pipeline()
+	pipe.Del(ctx, apiKeyPrefix+hash)
+	pipe.HDel(ctx, apiKeyIndexKey, *id)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to revoke API key: %w", err)
+	}
+
+	fmt.Printf("Revoked API key %s\n", *id)
+	return nil
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
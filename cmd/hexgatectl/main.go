@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"strings"
+)
+
+// hexgatectl is an offline admin tool for hexgate. It talks directly to the
+// Redis instance used by the gateway, so it also works against a local Redis.
+//
+// Usage:
+//
+//	hexgatectl token  -key private.pem -sub user-123 -exp 1h -kid k1 -claim plan=pro
+//	hexgatectl apikey create -sub user-123 -name ci -meta plan=pro
+//	hexgatectl apikey list
+//	hexgatectl apikey revoke -id key_1a2b3c4d
+//	hexgatectl apikey prune
+//	hexgatectl quota  -user user-123 -period 1m
+//	hexgatectl quota-override -user user-123 -limit 10000 -period 24h -ttl 720h
+//	hexgatectl metering-export -from 2026-10-01 -to 2026-11-01 -class 2xx > october.csv
+
+const usage = `Usage: hexgatectl <command> [flags]
+
+Commands:
+  token    Mint a signed JWT for testing
+  apikey   Create, list, revoke or prune API keys (create | list | revoke | prune)
+  quota    Inspect a user's current quota usage
+  quota-override
+           Raise or lower one user's quota, or clear the override (-clear)
+  metering-export
+           Export a billing period's request totals per user as CSV
+
+Run 'hexgatectl <command> -h' for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "token":
+		err = runToken(os.Args[2:])
+	case "apikey":
+		err = runAPIKey(os.Args[2:])
+	case "quota":
+		err = runQuota(os.Args[2:])
+	case "quota-override":
+		err = runQuotaOverride(os.Args[2:])
+	case "metering-export":
+		err = runMeteringExport(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "hexgatectl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// redisFlags registers the connection flags shared by all Redis backed commands.
+// They cover the same deployments as the gateway's redis section.
+type redisFlags struct {
+	addr             *string
+	mode             *string
+	master           *string
+	username         *string
+	password         *string
+	sentinelUsername *string
+	sentinelPassword *string
+	db               *int
+	tls              *bool
+	tlsCA            *string
+	tlsCert          *string
+	tlsKey           *string
+	tlsServerName    *string
+	tlsInsecure      *bool
+}
+
+func addRedisFlags(fs *flag.FlagSet) redisFlags {
+	return redisFlags{
+		addr:             fs.String("redis-addr", envOr("HEXGATE_REDIS_ADDR", "localhost:6379"), "Redis address, or comma separated sentinel/cluster node addresses"),
+		mode:             fs.String("redis-mode", envOr("HEXGATE_REDIS_MODE", "standalone"), "Redis mode: standalone, sentinel or cluster"),
+		master:           fs.String("redis-master", os.Getenv("HEXGATE_REDIS_MASTER"), "Sentinel master name"),
+		username:         fs.String("redis-username", os.Getenv("HEXGATE_REDIS_USERNAME"), "Redis ACL username"),
+		password:         fs.String("redis-password", os.Getenv("HEXGATE_REDIS_PASSWORD"), "Redis password"),
+		sentinelUsername: fs.String("redis-sentinel-username", os.Getenv("HEXGATE_REDIS_SENTINEL_USERNAME"), "Sentinel ACL username"),
+		sentinelPassword: fs.String("redis-sentinel-password", os.Getenv("HEXGATE_REDIS_SENTINEL_PASSWORD"), "Sentinel password"),
+		db:               fs.Int("redis-db", 0, "Redis database"),
+		tls:              fs.Bool("redis-tls", os.Getenv("HEXGATE_REDIS_TLS") == "true", "Connect to Redis over TLS"),
+		tlsCA:            fs.String("redis-tls-ca", os.Getenv("HEXGATE_REDIS_TLS_CA"), "CA file to verify Redis with instead of the system roots"),
+		tlsCert:          fs.String("redis-tls-cert", os.Getenv("HEXGATE_REDIS_TLS_CERT"), "Client certificate file, if Redis requires one"),
+		tlsKey:           fs.String("redis-tls-key", os.Getenv("HEXGATE_REDIS_TLS_KEY"), "Client key file"),
+		tlsServerName:    fs.String("redis-tls-server-name", os.Getenv("HEXGATE_REDIS_TLS_SERVER_NAME"), "Server name to verify the Redis certificate against"),
+		tlsInsecure:      fs.Bool("redis-tls-insecure", false, "Skip verifying the Redis certificate"),
+	}
+}
+
+func (f redisFlags) client() (redis.UniversalClient, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            strings.Split(*f.addr, ","),
+		MasterName:       *f.master,
+		Username:         *f.username,
+		Password:         *f.password,
+		SentinelUsername: *f.sentinelUsername,
+		SentinelPassword: *f.sentinelPassword,
+		DB:               *f.db,
+	}
+	if *f.tls {
+		tlsCfg, err := f.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		opts.TLSConfig = tlsCfg
+	}
+
+	switch *f.mode {
+	case "sentinel":
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case "cluster":
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
+	}
+}
+
+func (f redisFlags) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         *f.tlsServerName,
+		InsecureSkipVerify: *f.tlsInsecure,
+	}
+	if *f.tlsCA != "" {
+		data, err := os.ReadFile(*f.tlsCA)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("Redis CA file contains no valid certificates")
+		}
+		tlsCfg.RootCAs = pool
+	}
+	if *f.tlsCert != "" || *f.tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*f.tlsCert, *f.tlsKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not load Redis client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// kvFlag collects repeated key=value flags
+type kvFlag map[string]string
+
+func (kv kvFlag) String() string {
+	pairs := make([]string, 0, len(kv))
+	for k, v := range kv {
+		pairs = append(pairs, k+"="+v)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (kv kvFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	kv[k] = v
+	return nil
+}
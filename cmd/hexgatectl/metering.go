@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// meterRecord must match metering.go in the gateway
+type meterRecord struct {
+	ID      string    `json:"id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Subject string    `json:"sub"`
+	Service string    `json:"service"`
+	Class   string    `json:"class"`
+	Count   int64     `json:"count"`
+}
+
+type meterTotal struct {
+	subject, service, class string
+}
+
+// runMeteringExport sums the metering rollups that started within a billing
+// period and writes one CSV row per caller, service and status class. A record
+// written twice, when a gateway retried a flush that partly succeeded, is only
+// counted once.
+func runMeteringExport(args []string) error {
+	fs := flag.NewFlagSet("metering-export", flag.ExitOnError)
+	rf := addRedisFlags(fs)
+	source := fs.String("source", "redis", "Where the gateway writes metering records: redis or file")
+	stream := fs.String("stream", "metering", "Redis stream holding the records")
+	path := fs.String("file", "metering.jsonl", "JSONL file holding the records")
+	from := fs.String("from", "", "Start of the billing period (YYYY-MM-DD or RFC 3339, inclusive)")
+	to := fs.String("to", "", "End of the billing period (YYYY-MM-DD or RFC 3339, exclusive)")
+	class := fs.String("class", "", "Only count one status class, e.g. 2xx")
+	flushInterval := fs.Duration("flush-interval", time.Minute, "Metering flushInterval of the gateways")
+	slack := fs.Duration("slack", time.Hour, "How late after its flush a record may still reach the stream, e.g. after a Redis outage")
+	out := fs.String("o", "", "Write the CSV to this file instead of stdout")
+	fs.Parse(args)
+
+	start, err := parseDay(*from)
+	if err != nil {
+		return fmt.Errorf("-from: %w", err)
+	}
+	end, err := parseDay(*to)
+	if err != nil {
+		return fmt.Errorf("-to: %w", err)
+	}
+	if !end.After(start) {
+		return errors.New("-to must be after -from")
+	}
+
+	totals := make(map[meterTotal]int64)
+	seen := make(map[string]bool)
+	add := func(rec meterRecord) {
+		if rec.Start.Before(start) || !rec.Start.Before(end) || (*class != "" && rec.Class != *class) {
+			return
+		}
+		if rec.ID != "" {
+			if seen[rec.ID] {
+				return
+			}
+			seen[rec.ID] = true
+		}
+		totals[meterTotal{rec.Subject, rec.Service, rec.Class}] += rec.Count
+	}
+
+	switch *source {
+	case "redis":
+		var rdb redis.UniversalClient
+		if rdb, err = rf.client(); err != nil {
+			return err
+		}
+		defer rdb.Close()
+		err = readMeteringStream(context.Background(), rdb, *stream, start, end.Add(*flushInterval+*slack), add)
+	case "file":
+		err = readMeteringFile(*path, add)
+	default:
+		err = fmt.Errorf("unknown source %q", *source)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer w.Close()
+	}
+	return writeMeteringCSV(w, totals)
+}
+
+func parseDay(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, errors.New("required")
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// readMeteringStream passes every entry added between from and until to add.
+// Entry IDs are the time a rollup was flushed, not when it started, and rollups
+// of different gateways interleave, so the caller filters on Start and extends
+// until past the end of the period by the flush interval and some slack.
+func readMeteringStream(ctx context.Context, rdb redis.UniversalClient, stream string, from, until time.Time, add func(meterRecord)) error {
+	cursor := strconv.FormatInt(from.UnixMilli(), 10)
+	last := strconv.FormatInt(until.UnixMilli(), 10)
+	for {
+		entries, err := rdb.XRangeN(ctx, stream, cursor, last, 1000).Result()
+		if err != nil {
+			return fmt.Errorf("failed to read metering stream: %w", err)
+		}
+		for _, entry := range entries {
+			data, _ := entry.Values["record"].(string)
+			var rec meterRecord
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				return fmt.Errorf("invalid metering entry %s: %w", entry.ID, err)
+			}
+			add(rec)
+		}
+		if len(entries) < 1000 {
+			return nil
+		}
+		cursor = "(" + entries[len(entries)-1].ID
+	}
+}
+
+func readMeteringFile(path string, add func(meterRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var rec meterRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// A write the gateway failed and retried leaves a truncated line
+			fmt.Fprintf(os.Stderr, "Skipping %s:%d: %v\n", path, line, err)
+			continue
+		}
+		add(rec)
+	}
+	return scanner.Err()
+}
+
+func writeMeteringCSV(w *os.File, totals map[meterTotal]int64) error {
+	keys := make([]meterTotal, 0, len(totals))
+	for k := range totals {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.subject != b.subject {
+			return a.subject < b.subject
+		}
+		if a.service != b.service {
+			return a.service < b.service
+		}
+		return a.class < b.class
+	})
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"sub", "service", "class", "requests"})
+	for _, k := range keys {
+		cw.Write([]string{k.subject, k.service, k.class, strconv.FormatInt(totals[k], 10)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"os"
+	"strconv"
+	"time"
+)
+
+func runToken(args []string) error {
+	fs := flag.NewFlagSet("token", flag.ExitOnError)
+	keyPath := fs.String("key", "private.pem", "PEM encoded RSA private key used to sign the token")
+	subject := fs.String("sub", "", "Subject (user ID) of the token")
+	issuer := fs.String("iss", "", "Issuer claim")
+	audience := fs.String("aud", "", "Audience claim")
+	kid := fs.String("kid", "", "Key ID placed in the token header")
+	expiresIn := fs.Duration("exp", 24*time.Hour, "Token lifetime; negative values mint an already expired token")
+	claims := kvFlag{}
+	fs.Var(claims, "claim", "Extra claim as key=value (repeatable). Numbers and booleans are kept as JSON types")
+	fs.Parse(args)
+
+	if *subject == "" {
+		return errors.New("-sub is required")
+	}
+
+	privKey, err := loadPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	mapClaims := jwt.MapClaims{
+		"sub": *subject,
+		"iat": now.Unix(),
+		"exp": now.Add(*expiresIn).Unix(),
+	}
+	if *issuer != "" {
+		mapClaims["iss"] = *issuer
+	}
+	if *audience != "" {
+		mapClaims["aud"] = *audience
+	}
+	for k, v := range claims {
+		mapClaims[k] = claimValue(v)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, mapClaims)
+	if *kid != "" {
+		token.Header["kid"] = *kid
+	}
+
+	tokenString, err := token.SignedString(privKey)
+	if err != nil {
+		return fmt.Errorf("failed to sign token: %w", err)
+	}
+	fmt.Println(tokenString)
+	return nil
+}
+
+// claimValue keeps numeric and boolean claims typed so that e.g. exp overrides work
+func claimValue(s string) interface{} {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return n
+	}
+	if b, err := strconv.ParseBool(s); err == nil {
+		return b
+	}
+	return s
+}
+
+// loadPrivateKey reads and parses a PEM-encoded RSA private key (PKCS1 or PKCS8)
+func loadPrivateKey(path string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read private key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("failed to decode PEM block containing private key")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	pk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key (tried PKCS1 and PKCS8): %w", err)
+	}
+	key, ok := pk.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not a valid RSA private key")
+	}
+	return key, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	concurrencyPrefix        = "concurrency:"
+	defaultLeaseTTL          = 30 * time.Second
+	concurrencyRetryInterval = 50 * time.Millisecond
+)
+
+// ConcurrencyConfig limits the number of requests in flight at the same time,
+// which time window quotas cannot do for long-running requests
+type ConcurrencyConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	PerKey   int64  `yaml:"perKey"`   // in-flight requests per key across all gateways, 0 for no limit
+	Key      string `yaml:"key"`      // same placeholders as the quota key, defaults to "{user}"
+	Local    int    `yaml:"local"`    // in-flight requests to the service on this gateway, 0 for no limit
+	MaxWait  string `yaml:"maxWait"`  // how long a request may queue for a slot; rejected at once if empty
+	LeaseTTL string `yaml:"leaseTTL"` // lifetime of a Redis slot lease, renewed while the request runs; default 30s
+}
+
+// Leases are members of concurrency:<key>, a sorted set scored by the time they
+// expire. A gateway that crashes stops renewing its leases, so their slots free
+// up after at most one lease TTL.
+//
+//	KEYS[1]  lease set
+//	ARGV[1]  lease ID
+//	ARGV[2]  limit (acquire only)
+//	ARGV[3]  lease TTL in ms
+var acquireLeaseScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[2]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+// renewLeaseScript extends a lease, returning 0 if it has already expired
+var renewLeaseScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local ttl = tonumber(ARGV[3])
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+  return 0
+end
+redis.call('ZADD', KEYS[1], now + ttl, ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ttl)
+return 1
+`)
+
+type leaseLimiter struct {
+	rdb   redis.UniversalClient
+	limit int64
+	ttl   time.Duration
+}
+
+// acquire takes a slot for key, returning the lease ID or "" if all slots are taken
+func (l *leaseLimiter) acquire(ctx context.Context, key string) (string, error) {
+	id := requestToken()
+	ok, err := acquireLeaseScript.Run(ctx, l.rdb, []string{concurrencyPrefix + key}, id, l.limit, l.ttl.Milliseconds()).Int()
+	if err != nil || ok == 0 {
+		return "", err
+	}
+	return id, nil
+}
+
+// hold keeps renewing a lease until the returned release function is called
+func (l *leaseLimiter) hold(key, id string) (release func()) {
+	setKey := concurrencyPrefix + key
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				ok, err := renewLeaseScript.Run(context.Background(), l.rdb, []string{setKey}, id, 0, l.ttl.Milliseconds()).Int()
+				if err != nil {
+					slog.Warn("Failed to renew concurrency lease", "concurrency_key", key, "error", err)
+				} else if ok == 0 {
+					slog.Warn("Concurrency lease expired before the request finished", "concurrency_key", key)
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := l.rdb.ZRem(ctx, setKey, id).Err(); err != nil {
+			slog.Warn("Failed to release concurrency lease", "concurrency_key", key, "error", err)
+		}
+	}
+}
+
+// concurrencyMiddleware caps the requests in flight per key (shared through
+// Redis) and per service on this gateway. If Redis is unavailable only the local
+// cap applies.
+func concurrencyMiddleware(next http.Handler, serviceName string, cfg ConcurrencyConfig, ips *ipResolver, rdb redis.UniversalClient) (http.Handler, error) {
+	keyTemplate, err := parseQuotaKey(cfg.Key)
+	if err != nil {
+		return nil, err
+	}
+	maxWait, err := parseDurationOr(cfg.MaxWait, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid maxWait: %w", err)
+	}
+	leaseTTL, err := parseDurationOr(cfg.LeaseTTL, defaultLeaseTTL)
+	if err != nil || leaseTTL <= 0 {
+		return nil, fmt.Errorf("invalid leaseTTL '%s'", cfg.LeaseTTL)
+	}
+	if cfg.PerKey <= 0 && cfg.Local <= 0 {
+		return nil, errors.New("needs perKey or local")
+	}
+
+	leases := &leaseLimiter{rdb: rdb, limit: cfg.PerKey, ttl: leaseTTL}
+	var slots chan struct{}
+	if cfg.Local > 0 {
+		slots = make(chan struct{}, cfg.Local)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		waitCtx, cancel := context.WithTimeout(r.Context(), maxWait)
+		defer cancel()
+
+		if slots != nil {
+			if !acquireSlot(waitCtx, slots, maxWait > 0) {
+				concurrencyRejectedTotal.WithLabelValues(serviceName, "local").Inc()
+				writeConcurrencyExceeded(w, r, "Too many requests in flight for this service")
+				return
+			}
+			defer func() { <-slots }()
+		}
+
+		if cfg.PerKey > 0 {
+			key, err := keyTemplate.render(r, serviceName, ips)
+			if err != nil {
+				writeKeyError(w, r, "Concurrency", cfg.Key, err)
+				return
+			}
+
+			id, err := acquireLease(r.Context(), waitCtx, leases, key)
+			switch {
+			case err != nil:
+				// Fail open: the local cap still protects the backend
+				if !errors.Is(err, errCircuitOpen) {
+					loggerFrom(r.Context()).Warn("Concurrency lease failed, skipping the per-key limit", "concurrency_key", key, "error", err)
+				}
+			case id == "":
+				concurrencyRejectedTotal.WithLabelValues(serviceName, "key").Inc()
+				loggerFrom(r.Context()).Info("Concurrency limit reached", "concurrency_key", key, "limit", cfg.PerKey)
+				writeConcurrencyExceeded(w, r, "Too many concurrent requests")
+				return
+			default:
+				defer leases.hold(key, id)()
+			}
+		}
+
+		concurrencyInFlight.WithLabelValues(serviceName).Inc()
+		defer concurrencyInFlight.WithLabelValues(serviceName).Dec()
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// acquireSlot takes a local slot, waiting until waitCtx is done if wait is set
+func acquireSlot(waitCtx context.Context, slots chan struct{}, wait bool) bool {
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+	}
+	if !wait {
+		return false
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-waitCtx.Done():
+		return false
+	}
+}
+
+// acquireLease polls for a lease until one is free or waitCtx is done. Redis
+// calls use ctx, so running out of wait time is not mistaken for a Redis failure.
+func acquireLease(ctx, waitCtx context.Context, leases *leaseLimiter, key string) (string, error) {
+	for {
+		if !redisBreaker.Allow() {
+			return "", errCircuitOpen
+		}
+		id, err := leases.acquire(ctx, key)
+		redisBreaker.Record(err)
+		if err != nil || id != "" {
+			return id, err
+		}
+
+		select {
+		case <-waitCtx.Done():
+			return "", nil
+		case <-time.After(concurrencyRetryInterval):
+		}
+	}
+}
+
+// writeConcurrencyExceeded writes a 429 with an RFC 9457 problem body
+func writeConcurrencyExceeded(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("Retry-After", "1")
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":      "about:blank",
+		"title":     "Too Many Requests",
+		"status":    http.StatusTooManyRequests,
+		"detail":    detail,
+		"requestId": requestIDFrom(r.Context()),
+	})
+}
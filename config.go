@@ -4,8 +4,9 @@ import (
 	"fmt"
 	"github.com/hashicorp/consul/api"
 	"gopkg.in/yaml.v3"
-	"log"
+	"log/slog"
 	"sync/atomic"
+	"time"
 )
 
 const consulConfigKey = "hexgate/config"
@@ -19,7 +20,7 @@ func parseConfig(data []byte) (*Config, error) {
 }
 
 func loadInitialConfigFromConsul(client *api.Client, key string) (*Config, uint64, error) {
-	log.Printf("Loading initial configuration from Consul KV: %s", key)
+	slog.Info("Loading initial configuration from Consul KV", "key", key)
 	kvPair, _, err := client.KV().Get(key, nil)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to fetch initial config from Consul: %w", err)
@@ -34,12 +35,12 @@ func loadInitialConfigFromConsul(client *api.Client, key string) (*Config, uint6
 		return nil, 0, fmt.Errorf("failed to parse initial config from Consul: %w", err)
 	}
 
-	log.Println("Successfully loaded initial configuration from Consul")
+	slog.Info("Loaded initial configuration from Consul")
 	return cfg, kvPair.ModifyIndex, nil
 }
 
 func watchConsulConfig(key string, initialIndex uint64, globalRouter *atomic.Value, consulClient *api.Client) {
-	log.Printf("Starting Consul config watcher for key: %s", key)
+	slog.Info("Starting Consul config watcher", "key", key)
 	lastIndex := initialIndex
 
 	for {
@@ -48,12 +49,14 @@ func watchConsulConfig(key string, initialIndex uint64, globalRouter *atomic.Val
 		}
 		kvPair, meta, err := consulClient.KV().Get(key, opts)
 		if err != nil {
-			log.Printf("Error watching Consul config key %s: %v. Retrying in 5s...", key, err)
+			slog.Error("Error watching Consul config key, retrying in 5s", "key", key, "error", err)
+			time.Sleep(5 * time.Second)
 			continue
 		}
+		consulLastSuccess.WithLabelValues("config", key).SetToCurrentTime()
 
 		if kvPair == nil {
-			log.Printf("Config key '%s' is missing from Consul. Keeping old config.", key)
+			slog.Warn("Config key is missing from Consul, keeping old config", "key", key)
 			lastIndex = meta.LastIndex
 			continue
 		}
@@ -62,17 +65,28 @@ func watchConsulConfig(key string, initialIndex uint64, globalRouter *atomic.Val
 			continue
 		}
 
-		log.Println("Configuration change detected in Consul. Reloading...")
+		slog.Info("Configuration change detected in Consul, reloading")
 		lastIndex = kvPair.ModifyIndex
 
 		newCfg, err := parseConfig(kvPair.Value)
 		if err != nil {
-			log.Printf("Error reloading config from Consul: %v. Keeping old config.", err)
+			slog.Error("Error reloading config from Consul, keeping old config", "error", err)
+			configReloadsTotal.WithLabelValues("failure").Inc()
 			continue
 		}
+		if err := setupLogging(newCfg.Log); err != nil {
+			slog.Error("Invalid log configuration, keeping the current logger", "error", err)
+		}
 
-		newRouter := buildRouter(newCfg, consulClient)
+		newRouter, err := buildRouter(newCfg, consulClient)
+		if err != nil {
+			slog.Error("Invalid configuration in Consul, keeping old config", "error", err)
+			configReloadsTotal.WithLabelValues("failure").Inc()
+			continue
+		}
 		globalRouter.Store(newRouter)
-		log.Println("Hot reload from Consul complete. New configuration is active.")
+		configGeneration.Inc()
+		configReloadsTotal.WithLabelValues("success").Inc()
+		slog.Info("Hot reload from Consul complete, new configuration is active")
 	}
 }
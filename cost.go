@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CostRule sets how many quota units matching requests consume. Rules are
+// checked in order and the first match wins; other requests cost 1.
+type CostRule struct {
+	Method string `yaml:"method"` // empty matches every method
+	Path   string `yaml:"path"`   // path prefix, e.g. /users/export
+	Cost   int64  `yaml:"cost"`
+}
+
+// validateCostRules rejects negative costs and costs no window of the policy
+// could ever admit, which would answer every matching request with 429
+func validateCostRules(rules []CostRule, policy *quotaPolicy, algorithm string) error {
+	for _, rule := range rules {
+		if rule.Cost < 0 {
+			return fmt.Errorf("cost rule %s %s: cost must not be negative", rule.Method, rule.Path)
+		}
+		if plan, window, ok := policy.smallestWindow(algorithm); ok && rule.Cost > window.capacity(algorithm) {
+			return fmt.Errorf("cost rule %s %s: cost %d exceeds the %d units the %s window of plan '%s' can admit",
+				rule.Method, rule.Path, rule.Cost, window.capacity(algorithm), window.Period, plan)
+		}
+	}
+	return nil
+}
+
+func requestCost(rules []CostRule, r *http.Request) int64 {
+	for _, rule := range rules {
+		if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, rule.Path) {
+			return rule.Cost
+		}
+	}
+	return 1
+}
+
+// costResponseWriter lets the backend report the real cost of a request in a
+// response header. Just before the headers are sent, charge is called with the
+// reported cost so the difference can be consumed and the RateLimit headers
+// updated.
+type costResponseWriter struct {
+	http.ResponseWriter
+	header      string
+	charge      func(cost int64)
+	wroteHeader bool
+}
+
+func (cw *costResponseWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		if v := cw.Header().Get(cw.header); v != "" {
+			// Cost accounting is internal, clients do not see the header
+			cw.Header().Del(cw.header)
+			if cost, err := strconv.ParseInt(v, 10, 64); err == nil && cost >= 0 {
+				cw.charge(cost)
+			}
+		}
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *costResponseWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap exposes the underlying writer to http.ResponseController, so the
+// reverse proxy can still flush streamed responses
+func (cw *costResponseWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// localLimiter is the in-process quota used while Redis is unavailable. Each
+// gateway only sees its share of the traffic, so limits are divided by the
+// estimated number of gateway instances. Every window is a token bucket.
+type localLimiter struct {
+	gateways int64
+
+	mu        sync.Mutex
+	buckets   map[string]*localBucket
+	lastSweep time.Time
+}
+
+type localBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64 // tokens per second
+	last     time.Time
+}
+
+func newLocalLimiter(gateways int64) *localLimiter {
+	return &localLimiter{
+		gateways:  max(gateways, 1),
+		buckets:   make(map[string]*localBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow consumes cost units from every window of key if all of them have budget
+// left, or regardless if force is set (see rateLimiter.Charge)
+func (l *localLimiter) Allow(key string, rules []quotaRule, cost int64, force bool) quotaDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	decision := quotaDecision{Allowed: true, Tripped: -1, Windows: make([]limitResult, len(rules))}
+	buckets := make([]*localBucket, len(rules))
+	for i, rule := range rules {
+		b := l.bucket(key+"|"+rule.Period.String(), rule, now)
+		buckets[i] = b
+		if decision.Allowed && b.tokens < float64(cost) {
+			decision.Allowed = false
+			decision.Tripped = i
+		}
+	}
+
+	for i, b := range buckets {
+		if decision.Allowed || force {
+			b.tokens -= float64(cost)
+		}
+		result := limitResult{
+			Limit:      int64(b.capacity),
+			Period:     rules[i].Period,
+			Remaining:  max(int64(math.Floor(b.tokens)), 0),
+			ResetAfter: secondsToDuration((b.capacity - b.tokens) / b.rate),
+		}
+		if b.tokens < float64(cost) {
+			result.RetryAfter = secondsToDuration((float64(cost) - b.tokens) / b.rate)
+		}
+		decision.Windows[i] = result
+	}
+	return decision
+}
+
+func (l *localLimiter) bucket(id string, rule quotaRule, now time.Time) *localBucket {
+	limit := max(rule.Limit/l.gateways, 1)
+	burst := limit
+	if rule.Burst > 0 {
+		burst = max(rule.Burst/l.gateways, 1)
+	}
+	capacity := float64(burst)
+	rate := float64(limit) / rule.Period.Seconds()
+
+	b, ok := l.buckets[id]
+	if !ok || b.capacity != capacity || b.rate != rate {
+		b = &localBucket{tokens: capacity, capacity: capacity, rate: rate, last: now}
+		l.buckets[id] = b
+		return b
+	}
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	return b
+}
+
+// sweep drops buckets that have refilled completely, at most once a minute
+func (l *localLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for id, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity {
+			delete(l.buckets, id)
+		}
+	}
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
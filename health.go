@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// readinessRedisTimeout bounds the Redis ping of a readiness check
+const readinessRedisTimeout = time.Second
+
+// healthzHandler answers as long as the process serves HTTP; it is meant for
+// liveness probes and checks no dependencies
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler reports whether the instance should get traffic: the config is
+// loaded, every pool has had its first answer from Consul and Redis responds.
+// Only the first sync counts; pools created by a config reload do not take a
+// ready instance out of rotation. The body lists each check, so a failing probe
+// says what is missing.
+func readyzHandler(router *atomic.Value, rdb redis.UniversalClient) http.Handler {
+	var synced atomic.Bool
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{"config": "ok", "consul": "ok", "redis": "ok"}
+		ready := true
+
+		gr, _ := router.Load().(*gatewayRouter)
+		if gr == nil {
+			checks["config"] = "not loaded"
+			ready = false
+		} else if !synced.Load() {
+			for _, pool := range gr.pools {
+				if !pool.synced.Load() {
+					checks["consul"] = "waiting for the first sync of " + pool.service
+					ready = false
+					break
+				}
+			}
+			if ready {
+				synced.Store(true)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), readinessRedisTimeout)
+		defer cancel()
+		if err := rdb.Ping(ctx).Err(); err != nil {
+			checks["redis"] = err.Error()
+			ready = false
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, map[string]interface{}{"ready": ready, "checks": checks})
+	})
+}
+
+var backendsDesc = prometheus.NewDesc(
+	"hexgate_backends",
+	"Number of backends per service pool by state (up or down).",
+	[]string{"service", "state"}, nil,
+)
+
+// poolCollector reports the backends of the active router's pools when
+// scraped, so pools replaced by a config reload do not leave stale series
+type poolCollector struct {
+	router *atomic.Value
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- backendsDesc
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	gr, _ := c.router.Load().(*gatewayRouter)
+	if gr == nil {
+		return
+	}
+	for _, pool := range gr.pools {
+		var up, down int
+		pool.mu.RLock()
+		for _, b := range pool.backends {
+			if b.isAlive.Load() {
+				up++
+			} else {
+				down++
+			}
+		}
+		pool.mu.RUnlock()
+		ch <- prometheus.MustNewConstMetric(backendsDesc, prometheus.GaugeValue, float64(up), pool.service, "up")
+		ch <- prometheus.MustNewConstMetric(backendsDesc, prometheus.GaugeValue, float64(down), pool.service, "down")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import "context"
+
+const (
+	identityKey   contextKey = "identity"
+	clientCertKey contextKey = "clientCert"
+)
+
+// Identity describes the authenticated caller of a request
+type Identity struct {
+	Subject    string
+	Source     string                 // how the caller was authenticated, e.g. "jwt" or "apikey"
+	Claims     map[string]interface{} // token claims, if the credential was a token
+	Metadata   map[string]string      // extra attributes attached to the credential
+	ClientCert string                 // identity of the verified client certificate, if any
+	KeyID      string                 // ID of the API key, if the credential was one
+}
+
+// withIdentity stores the caller identity in the context. The subject is also
+// stored under userIDKey for middlewares that only need the user ID, and in
+// the access log record.
+func withIdentity(ctx context.Context, id *Identity) context.Context {
+	if certID, ok := ctx.Value(clientCertKey).(string); ok && id.ClientCert == "" {
+		id.ClientCert = certID
+	}
+	if rec := accessRecordFrom(ctx); rec != nil {
+		rec.user = id.Subject
+	}
+	ctx = context.WithValue(ctx, identityKey, id)
+	return context.WithValue(ctx, userIDKey, id.Subject)
+}
+
+func identityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey).(*Identity)
+	return id, ok
+}
+
+// withClientCertID records a verified client certificate identity ahead of token
+// authentication, so it ends up in the Identity built by the token middleware
+func withClientCertID(ctx context.Context, certID string) context.Context {
+	return context.WithValue(ctx, clientCertKey, certID)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	introspectionCachePrefix     = "introspection:"
+	introspectionLocalCacheLimit = 10000
+)
+
+type IntrospectionConfig struct {
+	Endpoint         string `yaml:"endpoint"`
+	ClientID         string `yaml:"clientId"`
+	ClientSecret     string `yaml:"clientSecret"`
+	Timeout          string `yaml:"timeout"`          // e.g. "5s"
+	CacheTTL         string `yaml:"cacheTTL"`         // upper bound for caching active tokens, always capped by exp
+	NegativeCacheTTL string `yaml:"negativeCacheTTL"` // how long inactive tokens are remembered
+	RedisCache       bool   `yaml:"redisCache"`       // share cached results between gateway instances
+}
+
+// introspectionResponse is the RFC 7662 response. Only the members the gateway
+// uses are decoded into fields, the rest are kept in Claims.
+type introspectionResponse struct {
+	Active   bool                   `json:"active"`
+	Subject  string                 `json:"sub"`
+	Username string                 `json:"username"`
+	ClientID string                 `json:"client_id"`
+	Exp      int64                  `json:"exp"`
+	Claims   map[string]interface{} `json:"-"`
+}
+
+type cachedIntrospection struct {
+	response  *introspectionResponse
+	expiresAt time.Time
+}
+
+// introspector validates opaque tokens against an OAuth2 introspection endpoint
+type introspector struct {
+	cfg         IntrospectionConfig
+	client      *http.Client
+	rdb         redis.UniversalClient
+	cacheTTL    time.Duration
+	negativeTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedIntrospection // sha256(token) -> result
+}
+
+func newIntrospector(cfg IntrospectionConfig, rdb redis.UniversalClient) (*introspector, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("introspection endpoint is required")
+	}
+
+	timeout, err := parseDurationOr(cfg.Timeout, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid introspection timeout: %w", err)
+	}
+	cacheTTL, err := parseDurationOr(cfg.CacheTTL, 5*time.Minute)
+	if err != nil {
+		return nil, fmt.Errorf("invalid introspection cacheTTL: %w", err)
+	}
+	negativeTTL, err := parseDurationOr(cfg.NegativeCacheTTL, 30*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid introspection negativeCacheTTL: %w", err)
+	}
+
+	in := &introspector{
+		cfg:         cfg,
+		client:      &http.Client{Timeout: timeout},
+		cacheTTL:    cacheTTL,
+		negativeTTL: negativeTTL,
+		cache:       make(map[string]cachedIntrospection),
+	}
+	if cfg.RedisCache {
+		in.rdb = rdb
+	}
+	return in, nil
+}
+
+// parseDurationOr parses s, returning fallback when s is empty
+func parseDurationOr(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// Introspect returns the introspection result for a token, using the local and
+// Redis caches before calling the authorization server
+func (in *introspector) Introspect(ctx context.Context, token string) (*introspectionResponse, error) {
+	tokenHash := sha256Hex(token)
+	now := time.Now()
+
+	in.mu.Lock()
+	cached, ok := in.cache[tokenHash]
+	in.mu.Unlock()
+	if ok && now.Before(cached.expiresAt) {
+		return cached.response, nil
+	}
+
+	if in.rdb != nil {
+		data, err := in.rdb.Get(ctx, introspectionCachePrefix+tokenHash).Bytes()
+		if err == nil {
+			if resp, err := decodeIntrospectionResponse(data); err == nil {
+				in.store(tokenHash, resp, now)
+				return resp, nil
+			}
+		} else if !errors.Is(err, redis.Nil) {
+			loggerFrom(ctx).Warn("Introspection cache lookup failed", "error", err)
+		}
+	}
+
+	data, err := in.call(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := decodeIntrospectionResponse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := in.store(tokenHash, resp, now)
+	if in.rdb != nil && ttl > 0 {
+		if err := in.rdb.Set(ctx, introspectionCachePrefix+tokenHash, data, ttl).Err(); err != nil {
+			loggerFrom(ctx).Warn("Failed to cache introspection result", "error", err)
+		}
+	}
+	return resp, nil
+}
+
+// store caches a result locally and returns how long it may be cached for
+func (in *introspector) store(tokenHash string, resp *introspectionResponse, now time.Time) time.Duration {
+	ttl := in.negativeTTL
+	if resp.Active {
+		ttl = in.cacheTTL
+		if resp.Exp > 0 {
+			ttl = min(ttl, time.Unix(resp.Exp, 0).Sub(now))
+		}
+	}
+	if ttl <= 0 {
+		return 0
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if len(in.cache) >= introspectionLocalCacheLimit {
+		for k, v := range in.cache {
+			if now.After(v.expiresAt) {
+				delete(in.cache, k)
+			}
+		}
+		// Still full of live entries: start over rather than grow without bound
+		if len(in.cache) >= introspectionLocalCacheLimit {
+			in.cache = make(map[string]cachedIntrospection)
+		}
+	}
+	in.cache[tokenHash] = cachedIntrospection{response: resp, expiresAt: now.Add(ttl)}
+	return ttl
+}
+
+func (in *introspector) call(ctx context.Context, token string) ([]byte, error) {
+	form := url.Values{}
+	form.Set("token", token)
+	form.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, in.cfg.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if in.cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(in.cfg.ClientID), url.QueryEscape(in.cfg.ClientSecret))
+	}
+
+	resp, err := in.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspection request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("could not decode introspection response: %w", err)
+	}
+	return raw, nil
+}
+
+func decodeIntrospectionResponse(data []byte) (*introspectionResponse, error) {
+	var resp introspectionResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("could not decode introspection response: %w", err)
+	}
+	if err := json.Unmarshal(data, &resp.Claims); err != nil {
+		return nil, fmt.Errorf("could not decode introspection response: %w", err)
+	}
+	return &resp, nil
+}
+
+// introspectionAuthMiddleware authenticates opaque bearer tokens through RFC 7662 introspection
+func introspectionAuthMiddleware(next http.Handler, in *introspector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader := r.Header.Get("Authorization")
+		if authHeader == "" {
+			httpError(w, r, "401 Unauthorized: Missing Authorization header", http.StatusUnauthorized)
+			return
+		}
+
+		token, found := strings.CutPrefix(authHeader, "Bearer ")
+		if !found {
+			httpError(w, r, "401 Unauthorized: Invalid Authorization header format", http.StatusUnauthorized)
+			return
+		}
+
+		resp, err := in.Introspect(r.Context(), token)
+		if err != nil {
+			loggerFrom(r.Context()).Error("Token introspection error", "error", err)
+			httpError(w, r, "503 Service Unavailable: Could not validate token", http.StatusServiceUnavailable)
+			return
+		}
+		if !resp.Active || (resp.Exp > 0 && time.Now().Unix() >= resp.Exp) {
+			httpError(w, r, "401 Unauthorized: Invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		subject := resp.Subject
+		if subject == "" {
+			subject = resp.Username
+		}
+		if subject == "" {
+			subject = resp.ClientID
+		}
+		if subject == "" {
+			loggerFrom(r.Context()).Info("Introspection response has no 'sub', 'username' or 'client_id'")
+			httpError(w, r, "401 Unauthorized: Invalid token claims", http.StatusUnauthorized)
+			return
+		}
+
+		ctx := withIdentity(r.Context(), &Identity{Subject: subject, Source: "introspection", Claims: resp.Claims})
+		loggerFrom(r.Context()).Debug("Token introspection authenticated", "user", subject)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ipratelimit:<prefix>:<window> counts the requests of one client prefix in a
+// fixed window, summed over all gateways by the optional Redis sync
+const ipRateLimitPrefix = "ipratelimit:"
+
+// IPRateLimitConfig limits requests per client address before authentication,
+// so floods and invalid token storms are turned away before any token is parsed
+type IPRateLimitConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Limit        int64    `yaml:"limit"`        // requests per period and client prefix
+	Period       string   `yaml:"period"`       // default 1s
+	Burst        int64    `yaml:"burst"`        // defaults to limit
+	IPv4Prefix   int      `yaml:"ipv4Prefix"`   // addresses are grouped per prefix, default 32
+	IPv6Prefix   int      `yaml:"ipv6Prefix"`   // default 64, as a single host usually owns a /64
+	Exempt       []string `yaml:"exempt"`       // CIDRs that are never limited, e.g. office ranges
+	RedisSync    bool     `yaml:"redisSync"`    // share counts between gateways through Redis
+	SyncInterval string   `yaml:"syncInterval"` // default 1s
+}
+
+// ipRateLimiter is a local token bucket per client prefix. With Redis sync every
+// gateway periodically adds its counts to a shared fixed window counter, and
+// prefixes over the limit across all gateways are blocked locally until the
+// window ends. Redis is never called on the request path.
+type ipRateLimiter struct {
+	rule     quotaRule
+	v4Mask   net.IPMask
+	v6Mask   net.IPMask
+	exempt   []*net.IPNet
+	ips      *ipResolver
+	buckets  *localLimiter
+	rdb      redis.UniversalClient
+	syncEach time.Duration
+
+	mu      sync.Mutex
+	pending map[string]int64     // prefix -> requests since the last sync
+	blocked map[string]time.Time // prefix -> end of the window it exceeded
+}
+
+func newIPRateLimiter(cfg IPRateLimitConfig, ips *ipResolver, rdb redis.UniversalClient) (*ipRateLimiter, error) {
+	period, err := parseDurationOr(cfg.Period, time.Second)
+	if err != nil || period <= 0 {
+		return nil, fmt.Errorf("invalid period '%s'", cfg.Period)
+	}
+	if cfg.Limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive")
+	}
+	syncEach, err := parseDurationOr(cfg.SyncInterval, time.Second)
+	if err != nil || syncEach <= 0 {
+		return nil, fmt.Errorf("invalid syncInterval '%s'", cfg.SyncInterval)
+	}
+	exempt, err := parseCIDRs(cfg.Exempt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exempt range: %w", err)
+	}
+
+	v4, v6 := cfg.IPv4Prefix, cfg.IPv6Prefix
+	if v4 == 0 {
+		v4 = 32
+	}
+	if v6 == 0 {
+		v6 = 64
+	}
+	if v4 < 0 || v4 > 32 || v6 < 0 || v6 > 128 {
+		return nil, fmt.Errorf("invalid prefix lengths /%d and /%d", v4, v6)
+	}
+
+	l := &ipRateLimiter{
+		rule:     quotaRule{Limit: cfg.Limit, Period: period, Burst: cfg.Burst},
+		v4Mask:   net.CIDRMask(v4, 32),
+		v6Mask:   net.CIDRMask(v6, 128),
+		exempt:   exempt,
+		ips:      ips,
+		buckets:  newLocalLimiter(1),
+		syncEach: syncEach,
+		pending:  make(map[string]int64),
+		blocked:  make(map[string]time.Time),
+	}
+	if cfg.RedisSync {
+		l.rdb = rdb
+	}
+	return l, nil
+}
+
+// prefix returns the network a client address is counted under, or "" if the
+// address is exempt or cannot be parsed
+func (l *ipRateLimiter) prefix(r *http.Request) string {
+	ip := net.ParseIP(l.ips.clientIP(r))
+	if ip == nil {
+		return ""
+	}
+	for _, network := range l.exempt {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	if v4 := ip.To4(); v4 != nil {
+		ones, _ := l.v4Mask.Size()
+		return fmt.Sprintf("%s/%d", v4.Mask(l.v4Mask), ones)
+	}
+	ones, _ := l.v6Mask.Size()
+	return fmt.Sprintf("%s/%d", ip.Mask(l.v6Mask), ones)
+}
+
+// allow reports whether a request from prefix may pass, and if not, how long
+// the client should wait
+func (l *ipRateLimiter) allow(prefix string) (bool, time.Duration) {
+	if l.rdb != nil {
+		l.mu.Lock()
+		until, blocked := l.blocked[prefix]
+		if blocked && time.Now().Before(until) {
+			l.mu.Unlock()
+			return false, time.Until(until)
+		}
+		l.pending[prefix]++
+		l.mu.Unlock()
+	}
+
+	decision := l.buckets.Allow(prefix, []quotaRule{l.rule}, 1, false)
+	return decision.Allowed, decision.Windows[0].RetryAfter
+}
+
+func (l *ipRateLimiter) startSync() {
+	if l.rdb == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(l.syncEach) {
+			if err := l.sync(context.Background()); err != nil {
+				slog.Warn("Failed to sync per-IP rate limits", "error", err)
+			}
+		}
+	}()
+}
+
+// sync adds the local counts to the shared window counters and blocks the
+// prefixes whose total is over the limit
+func (l *ipRateLimiter) sync(ctx context.Context) error {
+	now := time.Now()
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = make(map[string]int64)
+	for prefix, until := range l.blocked {
+		if now.After(until) {
+			delete(l.blocked, prefix)
+		}
+	}
+	l.mu.Unlock()
+	if len(pending) == 0 || !redisBreaker.Closed() {
+		return nil
+	}
+
+	window := now.UnixMilli() / l.rule.Period.Milliseconds()
+	windowEnd := time.UnixMilli((window + 1) * l.rule.Period.Milliseconds())
+	pipe := l.rdb.Pipeline()
+	totals := make(map[string]*redis.IntCmd, len(pending))
+	for prefix, count := range pending {
+		key := ipRateLimitPrefix + prefix + ":" + strconv.FormatInt(window, 10)
+		totals[prefix] = pipe.IncrBy(ctx, key, count)
+		pipe.PExpire(ctx, key, 2*l.rule.Period)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for prefix, total := range totals {
+		if total.Val() > l.rule.Limit {
+			l.blocked[prefix] = windowEnd
+		}
+	}
+	return nil
+}
+
+// ipRateLimitMiddleware rejects clients over their per-IP limit with 429. It
+// runs before routing and authentication.
+func ipRateLimitMiddleware(next http.Handler, limiter *ipRateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := limiter.prefix(r)
+		if prefix == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, retryAfter := limiter.allow(prefix); !ok {
+			ipRateLimitedTotal.Inc()
+			w.Header().Set("Retry-After", strconv.FormatInt(max(ceilSeconds(retryAfter), 1), 10))
+			httpError(w, r, "429 Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,17 +1,16 @@
 package main
 
 import (
-	"context"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt/v5"
-	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 type contextKey string
@@ -43,17 +42,18 @@ func loadPublicKey(path string) (*rsa.PublicKey, error) {
 }
 
 // jwtAuthMiddleware validates an RS256 JWT
-func jwtAuthMiddleware(next http.Handler, key *rsa.PublicKey) http.Handler {
+// Tokens are also checked against the revocation list, unless it is nil.
+func jwtAuthMiddleware(next http.Handler, key *rsa.PublicKey, revocations *revocationList) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "401 Unauthorized: Missing Authorization header", http.StatusUnauthorized)
+			httpError(w, r, "401 Unauthorized: Missing Authorization header", http.StatusUnauthorized)
 			return
 		}
 
 		tokenString, found := strings.CutPrefix(authHeader, "Bearer ")
 		if !found {
-			http.Error(w, "401 Unauthorized: Invalid Authorization header format", http.StatusUnauthorized)
+			httpError(w, r, "401 Unauthorized: Invalid Authorization header format", http.StatusUnauthorized)
 			return
 		}
 
@@ -65,25 +65,52 @@ func jwtAuthMiddleware(next http.Handler, key *rsa.PublicKey) http.Handler {
 		})
 
 		if err != nil {
-			log.Printf("Token validation error: %v", err)
-			http.Error(w, "401 Unauthorized: Invalid token", http.StatusUnauthorized)
+			loggerFrom(r.Context()).Info("Token validation error", "error", err)
+			httpError(w, r, "401 Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
 
 		if !token.Valid {
-			http.Error(w, "401 Unauthorized: Invalid token", http.StatusUnauthorized)
+			httpError(w, r, "401 Unauthorized: Invalid token", http.StatusUnauthorized)
 			return
 		}
 
-		log.Printf("Claims: %v", token.Claims)
-		userID, err := token.Claims.GetSubject()
+		serveVerifiedToken(w, r, next, token, "jwt", revocations)
+	})
+}
+
+// serveVerifiedToken turns the claims of a verified token into the request
+// identity and calls next. It is shared by the JWT and OIDC modes.
+func serveVerifiedToken(w http.ResponseWriter, r *http.Request, next http.Handler, token *jwt.Token, source string, revocations *revocationList) {
+	userID, err := token.Claims.GetSubject()
+	if err != nil {
+		loggerFrom(r.Context()).Info("Token missing 'sub' claim", "error", err)
+		httpError(w, r, "401 Unauthorized: Invalid token claims", http.StatusUnauthorized)
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+
+	if revocations != nil {
+		jti, _ := claims["jti"].(string)
+		var issuedAt time.Time
+		if iat, err := token.Claims.GetIssuedAt(); err == nil && iat != nil {
+			issuedAt = iat.Time
+		}
+		revoked, err := revocations.IsRevoked(r.Context(), jti, userID, issuedAt)
 		if err != nil {
-			log.Printf("Token missing 'sub' claim: %v", err)
-			http.Error(w, "401 Unauthorized: Invalid token claims", http.StatusUnauthorized)
+			loggerFrom(r.Context()).Error("Revocation check failed", "error", err)
+			httpError(w, r, "500 Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		ctx := context.WithValue(r.Context(), userIDKey, userID)
-		log.Println("JWT authenticated successfully")
-		next.ServeHTTP(w, r.WithContext(ctx))
-	})
+		if revoked {
+			loggerFrom(r.Context()).Info("Rejected revoked token", "user", userID)
+			httpError(w, r, "401 Unauthorized: Token has been revoked", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	identity := &Identity{Subject: userID, Source: source, Claims: claims}
+	ctx := withIdentity(r.Context(), identity)
+	loggerFrom(r.Context()).Debug("Token authenticated", "source", source, "user", userID)
+	next.ServeHTTP(w, r.WithContext(ctx))
 }
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const shedSampleKey contextKey = "loadShedSample"
+
+const (
+	sheddingGradient = "gradient"
+	sheddingAIMD     = "aimd"
+)
+
+const (
+	priorityNormal = iota
+	priorityHigh
+	priorityCritical
+)
+
+var priorityNames = []string{"normal", "high", "critical"}
+
+// LoadSheddingConfig enables an adaptive in-flight limit in front of a
+// service's backends. The limit is learned from response latency and requests
+// above it get a 503 right away instead of piling up on a degraded backend.
+type LoadSheddingConfig struct {
+	Enabled             bool     `yaml:"enabled"`
+	Algorithm           string   `yaml:"algorithm"`           // gradient (default) or aimd
+	InitialLimit        int      `yaml:"initialLimit"`        // default 20
+	MinLimit            int      `yaml:"minLimit"`            // default 5
+	MaxLimit            int      `yaml:"maxLimit"`            // default 1000
+	LatencyThreshold    string   `yaml:"latencyThreshold"`    // aimd only: slower responses count as overload, default 1s
+	CriticalPaths       []string `yaml:"criticalPaths"`       // path prefixes that are never shed, e.g. health checks
+	HighPriorityPlans   []string `yaml:"highPriorityPlans"`   // plans whose traffic is shed last
+	PlanClaim           string   `yaml:"planClaim"`           // defaults to the quota's planClaim
+	HighPriorityReserve float64  `yaml:"highPriorityReserve"` // share of the limit kept for high priority traffic, default 0.2
+}
+
+// adaptiveLimiter learns how many requests a server pool can have in flight.
+//
+// gradient compares a short and a long term average of the latency: as long as
+// they match the backend is keeping up and the limit grows by sqrt(limit); once
+// requests start queueing the short term latency rises and the limit shrinks
+// proportionally (by at most half).
+//
+// aimd grows the limit by one per fast response and cuts it by 10% for every
+// failed or slow one.
+type adaptiveLimiter struct {
+	service   string
+	algorithm string
+	minLimit  float64
+	maxLimit  float64
+	threshold time.Duration
+
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	shortRTT float64 // seconds
+	longRTT  float64
+}
+
+func newAdaptiveLimiter(service string, cfg LoadSheddingConfig) (*adaptiveLimiter, error) {
+	threshold, err := parseDurationOr(cfg.LatencyThreshold, time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("invalid latencyThreshold: %w", err)
+	}
+	l := &adaptiveLimiter{
+		service:   service,
+		algorithm: cfg.Algorithm,
+		minLimit:  float64(cfg.MinLimit),
+		maxLimit:  float64(cfg.MaxLimit),
+		limit:     float64(cfg.InitialLimit),
+		threshold: threshold,
+	}
+	if l.algorithm == "" {
+		l.algorithm = sheddingGradient
+	}
+	if l.algorithm != sheddingGradient && l.algorithm != sheddingAIMD {
+		return nil, fmt.Errorf("unknown load shedding algorithm '%s'", l.algorithm)
+	}
+	if l.minLimit <= 0 {
+		l.minLimit = 5
+	}
+	if l.maxLimit <= 0 {
+		l.maxLimit = 1000
+	}
+	if l.limit <= 0 {
+		l.limit = 20
+	}
+	if l.minLimit > l.maxLimit {
+		return nil, fmt.Errorf("minLimit %d is above maxLimit %d", cfg.MinLimit, cfg.MaxLimit)
+	}
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	loadSheddingLimit.WithLabelValues(service).Set(l.limit)
+	return l, nil
+}
+
+// acquire admits a request if the in-flight count is below the share of the
+// limit its priority may use. Critical requests are always admitted.
+func (l *adaptiveLimiter) acquire(priority int, reserve float64) (inFlight int, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	capacity := l.limit
+	if priority == priorityNormal {
+		capacity = l.limit * (1 - reserve)
+	}
+	if priority != priorityCritical && float64(l.inFlight) >= capacity {
+		return l.inFlight, false
+	}
+	l.inFlight++
+	return l.inFlight, true
+}
+
+// release records a finished request. inFlight is the count when it started,
+// dropped means the backend failed it.
+func (l *adaptiveLimiter) release(rtt time.Duration, inFlight int, dropped bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+
+	switch l.algorithm {
+	case sheddingAIMD:
+		if dropped || rtt > l.threshold {
+			l.limit *= 0.9
+		} else if float64(inFlight)*2 >= l.limit {
+			l.limit++
+		}
+	default:
+		sample := rtt.Seconds()
+		if l.longRTT == 0 {
+			l.shortRTT, l.longRTT = sample, sample
+		}
+		l.shortRTT = 0.9*l.shortRTT + 0.1*sample
+		l.longRTT = 0.99*l.longRTT + 0.01*sample
+		// After a sustained slowdown the long term average lags behind;
+		// pull it towards the present so the limit can recover
+		if l.longRTT > 2*l.shortRTT {
+			l.longRTT *= 0.95
+		}
+
+		// A pool that is not using half its limit says nothing about whether
+		// it could take more
+		if !dropped && float64(inFlight) < l.limit/2 {
+			return
+		}
+		gradient := math.Max(0.5, math.Min(1, 1.5*l.longRTT/l.shortRTT))
+		if dropped {
+			gradient = 0.5
+		}
+		newLimit := l.limit*gradient + math.Sqrt(l.limit)
+		l.limit = 0.8*l.limit + 0.2*newLimit
+	}
+
+	l.limit = math.Min(math.Max(l.limit, l.minLimit), l.maxLimit)
+	loadSheddingLimit.WithLabelValues(l.service).Set(l.limit)
+}
+
+// forget gives back the slot of a request that never reached the server pool,
+// e.g. one rejected by the quota, without taking it as a sample
+func (l *adaptiveLimiter) forget() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.inFlight--
+}
+
+// shedSample is what loadShedSampleMiddleware saw of a request at the server
+// pool. Requests that never got there leave it empty.
+type shedSample struct {
+	reached bool
+	rtt     time.Duration
+	dropped bool
+}
+
+// loadSheddingMiddleware sheds requests above the adaptive limit of a service's
+// server pool with 503. It sits outside the quota and metering, so shed
+// requests consume no quota and are not billed. It only learns from requests
+// that reached the pool, timed by loadShedSampleMiddleware around the proxy:
+// requests the gateway answers itself (quota, concurrency limit, Redis
+// failures) neither count as drops nor add the time spent in those middlewares.
+func loadSheddingMiddleware(next http.Handler, serviceName string, cfg LoadSheddingConfig, planClaim string) (http.Handler, error) {
+	limiter, err := newAdaptiveLimiter(serviceName, cfg)
+	if err != nil {
+		return nil, err
+	}
+	reserve := cfg.HighPriorityReserve
+	if reserve <= 0 {
+		reserve = 0.2
+	}
+	if cfg.PlanClaim != "" {
+		planClaim = cfg.PlanClaim
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		priority := requestPriority(r, cfg, planClaim)
+		inFlight, ok := limiter.acquire(priority, reserve)
+		if !ok {
+			loadShedTotal.WithLabelValues(serviceName, priorityNames[priority]).Inc()
+			w.Header().Set("Retry-After", "1")
+			httpError(w, r, "503 Service Unavailable: Service is overloaded", http.StatusServiceUnavailable)
+			return
+		}
+
+		sample := &shedSample{}
+		// Deferred, so a panic still gives the slot back
+		defer func() {
+			if !sample.reached {
+				limiter.forget()
+				return
+			}
+			limiter.release(sample.rtt, inFlight, sample.dropped)
+		}()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), shedSampleKey, sample)))
+	}), nil
+}
+
+// loadShedSampleMiddleware wraps the proxy of a service with load shedding and
+// records the round trip for the limiter
+func loadShedSampleMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sample, ok := r.Context().Value(shedSampleKey).(*shedSample)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sample.reached = true
+		start := time.Now()
+		rwi := newResponseWriterInterceptor(w)
+		completed := false
+		defer func() {
+			// A panic (the proxy aborts with http.ErrAbortHandler when the
+			// client goes away) counts as dropped
+			sample.rtt = time.Since(start)
+			sample.dropped = !completed || rwi.statusCode >= http.StatusInternalServerError
+		}()
+		next.ServeHTTP(rwi, r)
+		completed = true
+	})
+}
+
+func requestPriority(r *http.Request, cfg LoadSheddingConfig, planClaim string) int {
+	for _, prefix := range cfg.CriticalPaths {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return priorityCritical
+		}
+	}
+	if id, ok := identityFromContext(r.Context()); ok && planClaim != "" {
+		if slices.Contains(cfg.HighPriorityPlans, planOf(id, planClaim)) {
+			return priorityHigh
+		}
+	}
+	return priorityNormal
+}
+
+// planOf returns the plan named by a claim or API key metadata field, or ""
+func planOf(id *Identity, claim string) string {
+	if v, ok := id.Claims[claim].(string); ok {
+		return v
+	}
+	return id.Metadata[claim]
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const loggerKey contextKey = "logger"
+
+type LogConfig struct {
+	Level  string `yaml:"level"`  // debug, info (default), warn or error
+	Format string `yaml:"format"` // text (default) or json
+}
+
+// logLevel is shared by every handler setupLogging installs, so a config
+// reload can change the level of loggers that were already derived
+var logLevel = new(slog.LevelVar)
+
+// setupLogging installs the default logger described by cfg. It is called at
+// startup and on every config reload.
+func setupLogging(cfg LogConfig) error {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return fmt.Errorf("invalid log level '%s'", cfg.Level)
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid log format '%s'", cfg.Format)
+	}
+
+	logLevel.Set(level)
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// fatal logs at error level and exits, for configuration errors the gateway
+// cannot start with
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// loggerFrom returns the request-scoped logger stored in ctx, or the default
+// logger outside of a request
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+func withLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, logger)
+}
+
+// requestLoggerMiddleware adds the service name to the request logger, which
+// already carries the request ID
+func requestLoggerMiddleware(next http.Handler, serviceName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFrom(r.Context()).With("service", serviceName)
+		if rec := accessRecordFrom(r.Context()); rec != nil {
+			rec.service = serviceName
+		}
+		next.ServeHTTP(w, r.WithContext(withLogger(r.Context(), logger)))
+	})
+}
@@ -4,34 +4,62 @@ import (
 	"crypto/rsa"
 	"fmt"
 	"github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"log/slog"
 	"net/http"
+	"net/http/httptrace"
 	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type Config struct {
-	GatewayPort    string      `yaml:"gatewayPort"`
-	Services       []Service   `yaml:"services"`
-	Authentication AuthConfig  `yaml:"authentication"`
-	TLS            TLSConfig   `yaml:"tls"`
-	Redis          RedisConfig `yaml:"redis"`
+	GatewayPort    string                `yaml:"gatewayPort"`
+	Services       []Service             `yaml:"services"`
+	Authentication AuthConfig            `yaml:"authentication"`
+	TLS            TLSConfig             `yaml:"tls"`
+	Redis          RedisConfig           `yaml:"redis"`
+	Admin          AdminConfig           `yaml:"admin"`
+	Plans          map[string]PlanConfig `yaml:"plans"`
+	TrustedProxies []string              `yaml:"trustedProxies"` // CIDRs whose X-Forwarded-For entries are trusted
+	Metering       MeteringConfig        `yaml:"metering"`
+	IPRateLimit    IPRateLimitConfig     `yaml:"ipRateLimit"`
+	Log            LogConfig             `yaml:"log"`
+	AccessLog      AccessLogConfig       `yaml:"accessLog"`
+	RequestID      RequestIDConfig       `yaml:"requestId"`
+	Metrics        MetricsConfig         `yaml:"metrics"`
+	Tracing        TracingConfig         `yaml:"tracing"`
 }
 
 type Service struct {
-	Name              string      `yaml:"name"`
-	Path              string      `yaml:"path"`
-	ConsulServiceName string      `yaml:"consulServiceName"`
-	Quota             QuotaConfig `yaml:"quota"`
+	Name              string             `yaml:"name"`
+	Path              string             `yaml:"path"`
+	ConsulServiceName string             `yaml:"consulServiceName"`
+	Quota             QuotaConfig        `yaml:"quota"`
+	Concurrency       ConcurrencyConfig  `yaml:"concurrency"`
+	LoadShedding      LoadSheddingConfig `yaml:"loadShedding"`
+	ClientCert        ClientCertPolicy   `yaml:"clientCert"`
+	OIDC              OIDCConfig         `yaml:"oidc"`
 }
 
+const (
+	authModeJWT           = "jwt"
+	authModeIntrospection = "introspection"
+)
+
 type AuthConfig struct {
-	Enabled       bool   `yaml:"enabled"`
-	PublicKeyPath string `yaml:"publicKeyPath"`
+	Enabled       bool                `yaml:"enabled"`
+	Mode          string              `yaml:"mode"` // "jwt" (default) or "introspection"
+	PublicKeyPath string              `yaml:"publicKeyPath"`
+	APIKeys       APIKeyConfig        `yaml:"apiKeys"`
+	Introspection IntrospectionConfig `yaml:"introspection"`
+	Revocation    RevocationConfig    `yaml:"revocation"`
 }
 
 // Backend represents a single upstream server
@@ -43,20 +71,42 @@ type Backend struct {
 
 // ServerPool holds the list of available backends
 type ServerPool struct {
+	service  string              // name of the gateway service, for metrics
 	backends map[string]*Backend // Consul Service id -> Backend
 	current  uint64
 	mu       sync.RWMutex
+	synced   atomic.Bool // set once the first Consul answer has been applied
+}
+
+// gatewayRouter is the routing table built from one configuration, with the
+// pools behind it
+type gatewayRouter struct {
+	mux    *http.ServeMux
+	pools  []*ServerPool
+	quotas map[string]*serviceQuota // service name -> quota, for the admin API
+}
+
+func (gr *gatewayRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	gr.mux.ServeHTTP(w, r)
 }
 
 // NewServerPool creates a new server pool
-func NewServerPool() *ServerPool {
+func NewServerPool(service string) *ServerPool {
 	return &ServerPool{
+		service:  service,
 		backends: make(map[string]*Backend),
 		current:  0,
 	}
 }
 
-var redisClient *redis.Client
+var redisClient redis.UniversalClient
+
+var revocations *revocationList
+
+var quotaUsage *usageTracker
+
+// metering is nil unless metering is enabled
+var metering *meter
 
 func (s *ServerPool) RemoveBackend(serviceID string) {
 	s.mu.Lock()
@@ -64,7 +114,8 @@ func (s *ServerPool) RemoveBackend(serviceID string) {
 
 	if b, ok := s.backends[serviceID]; ok {
 		delete(s.backends, serviceID)
-		log.Printf("Removed backend: %s (ID: %s)", b.URL, serviceID)
+		upstreamInFlight.DeleteLabelValues(s.service, b.URL.Host)
+		slog.Info("Removed backend", "url", b.URL.String(), "id", serviceID)
 	}
 }
 
@@ -86,17 +137,22 @@ func (s *ServerPool) AddBackend(serviceID string, backendURL string) error {
 		URL: parsedURL,
 	}
 	proxy := httputil.NewSingleHostReverseProxy(parsedURL)
+	// Traces the upstream round trip and passes the trace context on to the backend
+	proxy.Transport = otelhttp.NewTransport(http.DefaultTransport, otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+		return "upstream " + r.Method
+	}))
 
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, e error) {
-		log.Printf("Backend error: %v", e)
+		loggerFrom(r.Context()).Error("Backend error, marking it down", "error", e)
+		upstreamErrorsTotal.WithLabelValues(s.service, parsedURL.Host).Inc()
 		backend.SetAlive(false)
-		http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+		httpError(w, r, "Service unavailable", http.StatusServiceUnavailable)
 	}
 
 	backend.SetAlive(true)
 	backend.ReverseProxy = proxy
 	s.backends[serviceID] = backend
-	log.Printf("Added backend: %s, id: %s", backendURL, serviceID)
+	slog.Info("Added backend", "url", backendURL, "id", serviceID)
 	return nil
 }
 
@@ -134,113 +190,367 @@ func newServiceHandler(pool *ServerPool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		backend := pool.GetNextBackend()
 		if backend == nil {
-			log.Println("No healthy backends for this service!")
-			http.Error(w, "Service unavailable", http.StatusServiceUnavailable)
+			loggerFrom(r.Context()).Warn("No healthy backends for this service")
+			httpError(w, r, "Service unavailable", http.StatusServiceUnavailable)
 			return
 		}
-		log.Printf("Forwarding request to: %s", backend.URL)
-		backend.ReverseProxy.ServeHTTP(w, r)
+		logger := loggerFrom(r.Context()).With("backend", backend.URL.String())
+		logger.Debug("Forwarding request")
+		host := backend.URL.Host
+		inFlight := upstreamInFlight.WithLabelValues(pool.service, host)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		start := time.Now()
+		var ttfb time.Duration
+		ctx := httptrace.WithClientTrace(withLogger(r.Context(), logger), &httptrace.ClientTrace{
+			GotFirstResponseByte: func() { ttfb = time.Since(start) },
+		})
+		rwi := newResponseWriterInterceptor(w)
+		backend.ReverseProxy.ServeHTTP(rwi, r.WithContext(ctx))
+		elapsed := time.Since(start)
+
+		upstreamDuration.WithLabelValues(pool.service, host).Observe(elapsed.Seconds())
+		// Without a first byte the round trip failed, which the proxy's error handler counts
+		if ttfb > 0 {
+			upstreamTTFB.WithLabelValues(pool.service, host).Observe(ttfb.Seconds())
+			upstreamResponsesTotal.WithLabelValues(pool.service, host, strconv.Itoa(rwi.statusCode)).Inc()
+		}
+		if rec := accessRecordFrom(r.Context()); rec != nil {
+			rec.upstream, rec.upstreamLatency = host, elapsed
+		}
 	}
 }
 
-func buildRouter(cfg *Config, consulClient *api.Client) *http.ServeMux {
-	log.Println("Building new router...")
+// buildRouter builds the routing table and middleware chains of a config. It
+// starts nothing until the whole config is valid, so a bad reload can be
+// rejected while the active router keeps serving.
+func buildRouter(cfg *Config, consulClient *api.Client) (*gatewayRouter, error) {
+	slog.Info("Building new router")
 	mux := http.NewServeMux()
+	var pools []*ServerPool
+	quotas := make(map[string]*serviceQuota)
 	var rsaPubKey *rsa.PublicKey
+	var tokenIntrospector *introspector
 	if cfg.Authentication.Enabled {
-		var err error
-		rsaPubKey, err = loadPublicKey(cfg.Authentication.PublicKeyPath)
+		switch cfg.Authentication.Mode {
+		case "", authModeJWT:
+			var err error
+			rsaPubKey, err = loadPublicKey(cfg.Authentication.PublicKeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load public key: %w", err)
+			}
+			slog.Info("Loaded RSA public key for JWT validation")
+		case authModeIntrospection:
+			var err error
+			tokenIntrospector, err = newIntrospector(cfg.Authentication.Introspection, redisClient)
+			if err != nil {
+				return nil, fmt.Errorf("failed to configure token introspection: %w", err)
+			}
+			slog.Info("Using token introspection", "endpoint", cfg.Authentication.Introspection.Endpoint)
+		default:
+			return nil, fmt.Errorf("unknown authentication mode '%s'", cfg.Authentication.Mode)
+		}
+	}
+
+	ips, err := newIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trustedProxies: %w", err)
+	}
+
+	var refreshInterval time.Duration
+	if cfg.Authentication.Revocation.Enabled {
+		refreshInterval, err = parseDurationOr(cfg.Authentication.Revocation.RefreshInterval, 30*time.Second)
 		if err != nil {
-			log.Fatalf("Failed to load public key: %v. Server cannot start.", err)
+			return nil, fmt.Errorf("invalid revocation refreshInterval: %w", err)
 		}
-		log.Println("Successfully loaded RSA public key for JWT validation.")
 	}
 
+	// Consul watchers of the pools, started once the config turned out valid
+	var watches []func()
+
 	for _, service := range cfg.Services {
 		if service.ConsulServiceName == "" {
-			log.Printf("Skipping service '%s': missing 'consulServiceName'", service.Name)
+			slog.Warn("Skipping service without consulServiceName", "service", service.Name)
 			continue
 		}
 
-		pool := NewServerPool()
-		pool.startConsulWatcher(consulClient, service.ConsulServiceName)
+		pool := NewServerPool(service.Name)
+		consulServiceName := service.ConsulServiceName
+		watches = append(watches, func() { pool.startConsulWatcher(consulClient, consulServiceName) })
+		pools = append(pools, pool)
 
 		// --- MIDDLEWARE CHAINING ---
 		var handler http.Handler = newServiceHandler(pool)
+		if service.LoadShedding.Enabled {
+			// Times the round trip the shedder learns from, see loadSheddingMiddleware
+			handler = loadShedSampleMiddleware(handler)
+		}
+		if metering != nil {
+			// Innermost, so only requests forwarded to a backend are billed
+			handler = meteringMiddleware(handler, service.Name, metering)
+		}
+
+		if service.Concurrency.Enabled {
+			keyTemplate, err := parseQuotaKey(service.Concurrency.Key)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid concurrency key: %w", service.Name, err)
+			}
+			if service.Concurrency.PerKey > 0 && keyTemplate.needsIdentity() && !cfg.Authentication.Enabled && !service.OIDC.Enabled && service.ClientCert.Mode == "" {
+				return nil, fmt.Errorf("service '%s': concurrency limit is keyed by identity, but neither authentication nor client certificates are enabled", service.Name)
+			}
+			slog.Info("Enabling concurrency limit", "service", service.Name)
+			// Inside the quota, so requests rejected by the quota never take a slot
+			handler, err = concurrencyMiddleware(handler, service.Name, service.Concurrency, ips, redisClient)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid concurrency configuration: %w", service.Name, err)
+			}
+		}
 
 		if service.Quota.Enabled {
-			if !cfg.Authentication.Enabled {
-				log.Fatalf("Service '%s' has quota enabled, but global authentication is disabled. Quota requires authentication.", service.Name)
+			keyTemplate, err := parseQuotaKey(service.Quota.Key)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid quota key: %w", service.Name, err)
+			}
+			if keyTemplate.needsIdentity() && !cfg.Authentication.Enabled && !service.OIDC.Enabled && service.ClientCert.Mode == "" {
+				return nil, fmt.Errorf("service '%s': quota is keyed by identity, but neither authentication nor client certificates are enabled", service.Name)
+			}
+			slog.Info("Enabling distributed quota", "service", service.Name)
+			handler = endStage(handler)
+			handler, err = quotaMiddleware(handler, service.Name, service.Quota, cfg.Plans, ips, redisClient, quotas)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid quota configuration: %w", service.Name, err)
 			}
-			log.Printf("Enabling distributed quota for service '%s'", service.Name)
-			handler = quotaMiddleware(handler, service.Quota, redisClient)
+			handler = startStage(handler, service.Name, "quota")
+		}
+
+		if service.LoadShedding.Enabled {
+			slog.Info("Enabling adaptive load shedding", "service", service.Name)
+			// Outside the quota and metering, so shed requests are neither charged nor billed
+			handler, err = loadSheddingMiddleware(handler, service.Name, service.LoadShedding, service.Quota.PlanClaim)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid load shedding configuration: %w", service.Name, err)
+			}
+		}
+
+		// Ends the auth span once authentication lets the request through
+		handler = endStage(handler)
+
+		var tokenRevocations *revocationList
+		if cfg.Authentication.Revocation.Enabled {
+			tokenRevocations = revocations
 		}
 
+		var authHandler http.Handler
 		if cfg.Authentication.Enabled {
-			log.Printf("Enabling JWT authentication for service '%s'", service.Name)
-			handler = jwtAuthMiddleware(handler, rsaPubKey)
+			if tokenIntrospector != nil {
+				slog.Info("Enabling token introspection", "service", service.Name)
+				authHandler = introspectionAuthMiddleware(handler, tokenIntrospector)
+			} else {
+				slog.Info("Enabling JWT authentication", "service", service.Name)
+				authHandler = jwtAuthMiddleware(handler, rsaPubKey, tokenRevocations)
+			}
+			if cfg.Authentication.APIKeys.Enabled {
+				slog.Info("Enabling API key authentication", "service", service.Name)
+				authHandler = apiKeyAuthMiddleware(handler, authHandler, cfg.Authentication.APIKeys, redisClient)
+			}
+		}
+
+		if service.OIDC.Enabled {
+			rp, err := newOIDCRelyingParty(service.OIDC, service.Path, redisClient)
+			if err != nil {
+				return nil, fmt.Errorf("service '%s': invalid OIDC configuration: %w", service.Name, err)
+			}
+			slog.Info("Enabling OIDC login", "service", service.Name)
+			authHandler = oidcMiddleware(handler, authHandler, rp, tokenRevocations)
+		}
+
+		switch service.ClientCert.Mode {
+		case clientCertModeCert, clientCertModeCertAndToken:
+			if !requestsClientCerts(cfg.TLS) {
+				return nil, fmt.Errorf("service '%s': client certificate mode '%s' needs tls.enabled and tls.clientAuth optional or require", service.Name, service.ClientCert.Mode)
+			}
+		}
+
+		switch service.ClientCert.Mode {
+		case "":
+			if authHandler != nil {
+				handler = authHandler
+			}
+		case clientCertModeCert:
+			slog.Info("Enabling client certificate authentication", "service", service.Name)
+			handler = clientCertAuthMiddleware(handler, nil, service.ClientCert)
+		case clientCertModeCertOrToken, clientCertModeCertAndToken:
+			if authHandler == nil {
+				return nil, fmt.Errorf("service '%s': client certificate mode '%s' needs global authentication, but it is disabled", service.Name, service.ClientCert.Mode)
+			}
+			slog.Info("Enabling client certificate authentication", "service", service.Name, "mode", service.ClientCert.Mode)
+			handler = clientCertAuthMiddleware(handler, authHandler, service.ClientCert)
+		default:
+			return nil, fmt.Errorf("service '%s': unknown client certificate mode '%s'", service.Name, service.ClientCert.Mode)
+		}
+		if authHandler != nil || service.ClientCert.Mode != "" {
+			handler = startStage(handler, service.Name, "auth")
 		}
 
 		handler = metricsMiddleware(handler, service.Name)
+		handler = tracingMiddleware(handler, service.Name)
+		handler = requestLoggerMiddleware(handler, service.Name)
 
 		mux.Handle(service.Path, handler)
-		log.Printf("Registered handler for service '%s' at path '%s'", service.Name, service.Path)
+		slog.Info("Registered service", "service", service.Name, "path", service.Path)
+	}
+
+	if cfg.Authentication.Revocation.Enabled {
+		revocations.start(refreshInterval)
+	}
+	for _, watch := range watches {
+		watch()
 	}
-	return mux
+	return &gatewayRouter{mux: mux, pools: pools, quotas: quotas}, nil
 }
 
 func main() {
 	consulClient, err := api.NewClient(api.DefaultConfig())
 	if err != nil {
-		log.Fatalf("Failed to create Consul client: %v", err)
+		fatal("Failed to create Consul client", "error", err)
 	}
 
 	cfg, lastIndex, err := loadInitialConfigFromConsul(consulClient, consulConfigKey)
 	if err != nil {
-		log.Fatalf("Failed to load initial configuration: %v", err)
+		fatal("Failed to load initial configuration", "error", err)
+	}
+	if err := setupLogging(cfg.Log); err != nil {
+		fatal("Invalid log configuration", "error", err)
 	}
 
 	redisClient, err = NewRedisClient(cfg.Redis)
+	if redisClient == nil {
+		fatal("Invalid Redis configuration", "error", err)
+	}
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		slog.Warn("Failed to connect to Redis, continuing without it until it is reachable", "error", err)
+	}
+
+	if err := registerHistograms(cfg.Metrics); err != nil {
+		fatal("Invalid metrics configuration", "error", err)
+	}
+
+	if cfg.Tracing.Enabled {
+		if err := setupTracing(cfg.Tracing, redisClient); err != nil {
+			fatal("Invalid tracing configuration", "error", err)
+		}
+		slog.Info("Tracing enabled", "exporter", cfg.Tracing.Exporter)
 	}
 
-	initialRouter := buildRouter(cfg, consulClient)
+	// Started by buildRouter once a config enables revocation; the admin API
+	// can record revocations either way
+	revocations = newRevocationList(redisClient)
+	quotaUsage = newUsageTracker(redisClient)
+	quotaUsage.start(usageFlushInterval)
+
+	if cfg.Metering.Enabled {
+		metering, err = newMeter(cfg.Metering, redisClient)
+		if err != nil {
+			fatal("Invalid metering configuration", "error", err)
+		}
+		flushInterval, err := parseDurationOr(cfg.Metering.FlushInterval, time.Minute)
+		if err != nil {
+			fatal("Invalid metering flushInterval", "error", err)
+		}
+		metering.start(flushInterval)
+	}
+
+	initialRouter, err := buildRouter(cfg, consulClient)
+	if err != nil {
+		fatal("Invalid configuration, server cannot start", "error", err)
+	}
 	var globalRouter atomic.Value
 	globalRouter.Store(initialRouter)
+	configGeneration.Inc()
+	prometheus.MustRegister(&poolCollector{router: &globalRouter})
 
 	go watchConsulConfig(consulConfigKey, lastIndex, &globalRouter, consulClient)
 
 	proxyRootHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		router := globalRouter.Load().(*http.ServeMux)
+		router := globalRouter.Load().(*gatewayRouter)
 		router.ServeHTTP(w, r)
 	})
 
+	if cfg.Admin.Enabled {
+		if cfg.Admin.Token == "" {
+			slog.Warn("Admin listener has no token configured; all admin requests will be rejected")
+		}
+		go func() {
+			slog.Info("Admin API listening", "port", cfg.Admin.Port)
+			if err := http.ListenAndServe(":"+cfg.Admin.Port, newAdminRouter(cfg.Admin, revocations, &globalRouter)); err != nil {
+				slog.Error("Admin server failed", "error", err)
+			}
+		}()
+	}
+
+	ips, err := newIPResolver(cfg.TrustedProxies)
+	if err != nil {
+		fatal("Invalid trustedProxies", "error", err)
+	}
+	var gatewayHandler http.Handler = proxyRootHandler
+	if cfg.IPRateLimit.Enabled {
+		ipLimiter, err := newIPRateLimiter(cfg.IPRateLimit, ips, redisClient)
+		if err != nil {
+			fatal("Invalid ipRateLimit configuration", "error", err)
+		}
+		ipLimiter.startSync()
+		gatewayHandler = ipRateLimitMiddleware(gatewayHandler, ipLimiter)
+	}
+
+	gatewayHandler, err = requestIDMiddleware(gatewayHandler, cfg.RequestID, ips)
+	if err != nil {
+		fatal("Invalid requestId configuration", "error", err)
+	}
+
+	if cfg.AccessLog.Enabled {
+		accessLog, err := newAccessLogger(cfg.AccessLog, ips)
+		if err != nil {
+			fatal("Invalid accessLog configuration", "error", err)
+		}
+		gatewayHandler = accessLogMiddleware(gatewayHandler, accessLog)
+	}
+
 	mainRouter := http.NewServeMux()
 	mainRouter.Handle("/metrics", promhttp.Handler())
-	mainRouter.Handle("/", proxyRootHandler)
+	mainRouter.HandleFunc("/healthz", healthzHandler)
+	mainRouter.Handle("/readyz", readyzHandler(&globalRouter, redisClient))
+	mainRouter.Handle("/", gatewayHandler)
 
 	if cfg.TLS.Enabled {
 		go func() {
 			httpPort := ":" + cfg.GatewayPort
-			log.Printf("Starting HTTP-to-HTTPS redirect server on port %s", cfg.GatewayPort)
+			slog.Info("Starting HTTP-to-HTTPS redirect server", "port", cfg.GatewayPort)
 			redirectMux := http.NewServeMux()
 			redirectMux.HandleFunc("/", createRedirectHandler(cfg.TLS.HTTPSPort))
 			if err := http.ListenAndServe(httpPort, redirectMux); err != nil {
 				// Don't use Fatalf here, as the main HTTPS server is the important one
-				log.Printf("Redirect server failed: %v", err)
+				slog.Error("Redirect server failed", "error", err)
 			}
 		}()
 
-		httpsPort := ":" + cfg.TLS.HTTPSPort
-		log.Printf("API Gateway (HTTPS) listening on port %s", cfg.TLS.HTTPSPort)
-		if err := http.ListenAndServeTLS(httpsPort, cfg.TLS.CertFile, cfg.TLS.KeyFile, mainRouter); err != nil {
-			log.Fatalf("Gateway server (HTTPS) failed: %v", err)
+		tlsConfig, err := serverTLSConfig(cfg.TLS)
+		if err != nil {
+			fatal("Invalid TLS configuration", "error", err)
+		}
+		server := &http.Server{
+			Addr:      ":" + cfg.TLS.HTTPSPort,
+			Handler:   mainRouter,
+			TLSConfig: tlsConfig,
+		}
+		slog.Info("API Gateway (HTTPS) listening", "port", cfg.TLS.HTTPSPort)
+		if err := server.ListenAndServeTLS(cfg.TLS.CertFile, cfg.TLS.KeyFile); err != nil {
+			fatal("Gateway server (HTTPS) failed", "error", err)
 		}
 	} else {
-		log.Printf("API Gateway listening on port %s", cfg.GatewayPort)
+		slog.Info("API Gateway listening", "port", cfg.GatewayPort)
 		if err := http.ListenAndServe(":"+cfg.GatewayPort, mainRouter); err != nil {
-			log.Fatalf("Gateway server failed: %v", err)
+			fatal("Gateway server failed", "error", err)
 		}
 	}
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	meteringSinkRedis = "redis"
+	meteringSinkFile  = "file"
+
+	defaultMeteringStream = "metering"
+	defaultMeteringFile   = "metering.jsonl"
+	// maxMeteringBacklog bounds the records kept in memory while the sink is failing
+	maxMeteringBacklog = 100000
+)
+
+// MeteringConfig enables per-caller usage records for billing. Rollups are
+// written either to a Redis stream (one entry per record, field "record") or
+// appended to a JSONL file; hexgatectl metering-export turns them into CSV.
+type MeteringConfig struct {
+	Enabled       bool   `yaml:"enabled"`
+	Sink          string `yaml:"sink"`          // redis (default) or file
+	Stream        string `yaml:"stream"`        // Redis stream, default "metering"
+	MaxLen        int64  `yaml:"maxLen"`        // approximate stream length cap, 0 for none
+	Path          string `yaml:"path"`          // JSONL file, default "metering.jsonl"
+	FlushInterval string `yaml:"flushInterval"` // default 1m
+}
+
+// meterRecord is the number of requests of one caller to one service with one
+// status class during [Start, End). hexgatectl decodes the same JSON.
+//
+// ID is <gateway instance>-<flush>-<index> and stays the same when a failed
+// write is retried, so the export can drop records a sink took twice.
+type meterRecord struct {
+	ID      string    `json:"id"`
+	Start   time.Time `json:"start"`
+	End     time.Time `json:"end"`
+	Subject string    `json:"sub"`
+	Service string    `json:"service"`
+	Class   string    `json:"class"` // 2xx, 4xx, ...
+	Count   int64     `json:"count"`
+}
+
+type meterKey struct {
+	subject, service, class string
+}
+
+type meterSink interface {
+	write(ctx context.Context, records []meterRecord) error
+}
+
+// meter aggregates requests in memory and flushes one rollup per interval
+type meter struct {
+	sink     meterSink
+	instance string // tells the records of different gateways apart
+
+	mu      sync.Mutex
+	flushes int64
+	since   time.Time
+	counts  map[meterKey]int64
+	backlog []meterRecord // records the sink failed to take, retried on the next flush
+}
+
+func newMeter(cfg MeteringConfig, rdb redis.UniversalClient) (*meter, error) {
+	var sink meterSink
+	switch cfg.Sink {
+	case "", meteringSinkRedis:
+		stream := cfg.Stream
+		if stream == "" {
+			stream = defaultMeteringStream
+		}
+		sink = &redisStreamSink{rdb: rdb, stream: stream, maxLen: cfg.MaxLen}
+	case meteringSinkFile:
+		path := cfg.Path
+		if path == "" {
+			path = defaultMeteringFile
+		}
+		sink = &fileSink{path: path}
+	default:
+		return nil, fmt.Errorf("unknown metering sink '%s'", cfg.Sink)
+	}
+	instance, _ := os.Hostname()
+	instance += "-" + newRequestID()[:8]
+	return &meter{sink: sink, instance: instance, since: time.Now().UTC(), counts: make(map[meterKey]int64)}, nil
+}
+
+// record counts one request. It is a no-op on a nil meter.
+func (m *meter) record(subject, service string, status int) {
+	if m == nil {
+		return
+	}
+	k := meterKey{subject: subject, service: service, class: fmt.Sprintf("%dxx", status/100)}
+	m.mu.Lock()
+	m.counts[k]++
+	m.mu.Unlock()
+}
+
+func (m *meter) start(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := m.flush(context.Background()); err != nil {
+				slog.Warn("Failed to flush metering records", "error", err)
+			}
+		}
+	}()
+}
+
+func (m *meter) flush(ctx context.Context) error {
+	now := time.Now().UTC()
+	m.mu.Lock()
+	records := m.backlog
+	m.flushes++
+	i := 0
+	for k, count := range m.counts {
+		id := fmt.Sprintf("%s-%d-%d", m.instance, m.flushes, i)
+		records = append(records, meterRecord{ID: id, Start: m.since, End: now, Subject: k.subject, Service: k.service, Class: k.class, Count: count})
+		i++
+	}
+	m.since = now
+	m.counts = make(map[meterKey]int64)
+	m.backlog = nil
+	m.mu.Unlock()
+
+	if len(records) == 0 {
+		return nil
+	}
+	if err := m.sink.write(ctx, records); err != nil {
+		m.mu.Lock()
+		if dropped := len(records) + len(m.backlog) - maxMeteringBacklog; dropped > 0 {
+			slog.Warn("Metering backlog is full, dropping records", "dropped", dropped)
+			records = records[dropped:]
+		}
+		m.backlog = append(records, m.backlog...)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+type redisStreamSink struct {
+	rdb    redis.UniversalClient
+	stream string
+	maxLen int64
+}
+
+func (s *redisStreamSink) write(ctx context.Context, records []meterRecord) error {
+	pipe := s.rdb.Pipeline()
+	for _, rec := range records {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.stream,
+			MaxLen: s.maxLen,
+			Approx: s.maxLen > 0,
+			Values: []interface{}{"record", data},
+		})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+type fileSink struct {
+	path string
+}
+
+func (s *fileSink) write(ctx context.Context, records []meterRecord) error {
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return err
+	}
+	// A failed write may have left half a line; start the retry on a new one
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range records {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// meteringMiddleware counts every request that reached it per caller and
+// status class. It wraps the proxy directly, so requests rejected by the
+// gateway itself (authentication, quota, concurrency, load shedding) are never
+// counted.
+func meteringMiddleware(next http.Handler, serviceName string, m *meter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rwi := newResponseWriterInterceptor(w)
+		next.ServeHTTP(rwi, r)
+
+		subject := "anonymous"
+		if id, ok := identityFromContext(r.Context()); ok && id.Subject != "" {
+			subject = id.Subject
+		}
+		m.record(subject, serviceName, rwi.statusCode)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"net/http"
@@ -18,16 +19,212 @@ var (
 		[]string{"service", "method", "code"},
 	)
 
+	// consulLastSuccess is when a Consul watch last got an answer, per watched
+	// service (kind "service") or config key (kind "config")
+	consulLastSuccess = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hexgate_consul_watch_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful Consul watch query.",
+		},
+		[]string{"kind", "name"},
+	)
+
+	// configGeneration counts the configurations activated since startup, 1 being the initial one
+	configGeneration = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "hexgate_config_generation",
+			Help: "Number of configurations activated since startup.",
+		},
+	)
+
+	// configReloadsTotal counts hot reloads from Consul by result
+	configReloadsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_config_reloads_total",
+			Help: "Total number of configuration reloads.",
+		},
+		[]string{"result"},
+	)
+
+	// upstreamResponsesTotal counts backend responses by backend address and status code
+	upstreamResponsesTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_upstream_responses_total",
+			Help: "Total number of responses received from backends.",
+		},
+		[]string{"service", "backend", "code"},
+	)
+
+	// upstreamErrorsTotal counts requests that got no response from a backend
+	// (connection refused, reset, timeout)
+	upstreamErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_upstream_errors_total",
+			Help: "Total number of failed round trips to backends.",
+		},
+		[]string{"service", "backend"},
+	)
+
+	// upstreamInFlight tracks the requests currently forwarded to each backend
+	upstreamInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hexgate_upstream_in_flight",
+			Help: "Number of requests in flight to each backend.",
+		},
+		[]string{"service", "backend"},
+	)
+
+	// quotaUnitsTotal counts consumed quota units, which differ from requests
+	// when cost rules apply
+	quotaUnitsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_quota_units_total",
+			Help: "Total number of quota units consumed.",
+		},
+		[]string{"service", "plan"},
+	)
+
+	// quotaWouldRejectTotal counts over-limit requests forwarded by quotas in shadow mode
+	quotaWouldRejectTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_quota_would_reject_total",
+			Help: "Total number of requests a quota in shadow mode would have rejected.",
+		},
+		[]string{"service", "plan"},
+	)
+
+	// quotaFallbackTotal counts quota checks that could not use Redis, by failure mode
+	quotaFallbackTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_quota_fallback_total",
+			Help: "Total number of quota checks handled by the Redis failure policy.",
+		},
+		[]string{"service", "mode"},
+	)
+
+	// concurrencyInFlight tracks the requests admitted by the concurrency limiter
+	concurrencyInFlight = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hexgate_concurrency_in_flight",
+			Help: "Number of requests in flight through the concurrency limiter.",
+		},
+		[]string{"service"},
+	)
+
+	// concurrencyRejectedTotal counts requests rejected by the local or per-key cap
+	concurrencyRejectedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_concurrency_rejected_total",
+			Help: "Total number of requests rejected by the concurrency limiter.",
+		},
+		[]string{"service", "scope"},
+	)
+
+	// loadSheddingLimit is the in-flight limit currently learned for a service
+	loadSheddingLimit = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hexgate_load_shedding_limit",
+			Help: "Adaptive in-flight limit of a service's server pool.",
+		},
+		[]string{"service"},
+	)
+
+	// loadShedTotal counts requests shed with 503, by priority class
+	loadShedTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "hexgate_load_shed_total",
+			Help: "Total number of requests shed by adaptive load shedding.",
+		},
+		[]string{"service", "priority"},
+	)
+
+	// ipRateLimitedTotal counts requests rejected by the per-IP limiter. Addresses
+	// are deliberately not a label.
+	ipRateLimitedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "hexgate_ip_rate_limited_total",
+			Help: "Total number of requests rejected by the per-IP rate limiter.",
+		},
+	)
+
+	// circuitBreakerState is 0 when closed, 1 when open and 2 when half-open
+	circuitBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "hexgate_circuit_breaker_state",
+			Help: "State of circuit breakers (0 closed, 1 open, 2 half-open).",
+		},
+		[]string{"name"},
+	)
+)
+
+// Latency histograms share the buckets set in the metrics config, so they are
+// registered by registerHistograms once the config is loaded
+var (
 	// httpRequestDuration is a Histogram vector to observe request latencies
+	// through the whole middleware chain
+	httpRequestDuration *prometheus.HistogramVec
+
+	// upstreamDuration is the round trip to the backend alone
+	upstreamDuration *prometheus.HistogramVec
+
+	// upstreamTTFB is the time until the first byte of the backend response
+	upstreamTTFB *prometheus.HistogramVec
+
+	// middlewareDuration is the time spent in a stage of the middleware chain
+	// (auth or quota), up to the point it lets the request through
+	middlewareDuration *prometheus.HistogramVec
+)
+
+// MetricsConfig tunes the Prometheus metrics. It is only read at startup.
+type MetricsConfig struct {
+	Buckets []float64 `yaml:"buckets"` // latency buckets in seconds, default prometheus.DefBuckets
+}
+
+func registerHistograms(cfg MetricsConfig) error {
+	buckets := cfg.Buckets
+	if len(buckets) == 0 {
+		buckets = prometheus.DefBuckets
+	}
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i] <= buckets[i-1] {
+			return fmt.Errorf("buckets must be in increasing order")
+		}
+	}
+
 	httpRequestDuration = promauto.NewHistogramVec(
 		prometheus.HistogramOpts{
 			Name:    "hexgate_http_request_duration_seconds",
 			Help:    "Histogram of HTTP request latencies.",
-			Buckets: prometheus.DefBuckets,
+			Buckets: buckets,
 		},
 		[]string{"service", "method"},
 	)
-)
+	upstreamDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hexgate_upstream_duration_seconds",
+			Help:    "Histogram of backend round trip latencies.",
+			Buckets: buckets,
+		},
+		[]string{"service", "backend"},
+	)
+	upstreamTTFB = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hexgate_upstream_ttfb_seconds",
+			Help:    "Histogram of the time to the first byte of backend responses.",
+			Buckets: buckets,
+		},
+		[]string{"service", "backend"},
+	)
+	middlewareDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "hexgate_middleware_duration_seconds",
+			Help:    "Histogram of the time spent in the auth and quota middlewares.",
+			Buckets: buckets,
+		},
+		[]string{"service", "stage"},
+	)
+	return nil
+}
 
 type responseWriterInterceptor struct {
 	http.ResponseWriter
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const (
+	clientCertModeCert         = "cert"           // a client certificate replaces the token
+	clientCertModeCertOrToken  = "cert-or-token"  // a client certificate or a token is accepted
+	clientCertModeCertAndToken = "cert-and-token" // both are required; the token provides the subject
+)
+
+// ClientCertPolicy configures client certificate authentication for a service
+type ClientCertPolicy struct {
+	Mode     string   `yaml:"mode"`     // "", "cert", "cert-or-token" or "cert-and-token"
+	Identity string   `yaml:"identity"` // "cn" (default), "uri" or "spiffe"
+	Allowed  []string `yaml:"allowed"`  // accepted identities; empty accepts any verified certificate
+}
+
+// serverTLSConfig builds the TLS config of the HTTPS listener, including client
+// certificate verification when a client CA bundle is configured
+func serverTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	switch cfg.ClientAuth {
+	case "", "none":
+		return tlsCfg, nil
+	case "optional":
+		tlsCfg.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown clientAuth '%s'", cfg.ClientAuth)
+	}
+
+	if cfg.ClientCAFile == "" {
+		return nil, errors.New("clientCAFile is required when client certificates are enabled")
+	}
+	data, err := os.ReadFile(cfg.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client CA file contains no valid certificates")
+	}
+	tlsCfg.ClientCAs = pool
+	return tlsCfg, nil
+}
+
+// requestsClientCerts reports whether the HTTPS listener asks clients for a
+// certificate, which the cert and cert-and-token modes cannot work without
+func requestsClientCerts(cfg TLSConfig) bool {
+	return cfg.Enabled && cfg.ClientAuth != "" && cfg.ClientAuth != "none"
+}
+
+// clientCertIdentity extracts the identity from the verified client certificate of a request
+func clientCertIdentity(r *http.Request, policy ClientCertPolicy) (string, bool) {
+	// VerifiedChains is only populated for certificates signed by a configured client CA
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	var id string
+	switch policy.Identity {
+	case "", "cn":
+		id = cert.Subject.CommonName
+	case "uri":
+		if len(cert.URIs) > 0 {
+			id = cert.URIs[0].String()
+		}
+	case "spiffe":
+		for _, uri := range cert.URIs {
+			if uri.Scheme == "spiffe" {
+				id = uri.String()
+				break
+			}
+		}
+	}
+	return id, id != ""
+}
+
+// clientCertAuthMiddleware authenticates requests by their client certificate.
+// tokenAuth is the token middleware chain (wrapping next) used by the modes that
+// also accept or require a token; it may be nil for mode "cert".
+func clientCertAuthMiddleware(next, tokenAuth http.Handler, policy ClientCertPolicy) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		certID, ok := clientCertIdentity(r, policy)
+		if ok && len(policy.Allowed) > 0 && !slices.Contains(policy.Allowed, certID) {
+			loggerFrom(r.Context()).Info("Client certificate identity is not allowed", "cert_id", certID)
+			if policy.Mode != clientCertModeCertOrToken {
+				httpError(w, r, "403 Forbidden: Client certificate not allowed", http.StatusForbidden)
+				return
+			}
+			// The caller may still authenticate with a token
+			ok = false
+		}
+
+		switch policy.Mode {
+		case clientCertModeCertOrToken:
+			if !ok {
+				tokenAuth.ServeHTTP(w, r)
+				return
+			}
+		case clientCertModeCertAndToken:
+			if !ok {
+				httpError(w, r, "401 Unauthorized: Client certificate required", http.StatusUnauthorized)
+				return
+			}
+			ctx := withClientCertID(r.Context(), certID)
+			tokenAuth.ServeHTTP(w, r.WithContext(ctx))
+			return
+		default:
+			if !ok {
+				httpError(w, r, "401 Unauthorized: Client certificate required", http.StatusUnauthorized)
+				return
+			}
+		}
+
+		ctx := withIdentity(r.Context(), &Identity{Subject: certID, Source: "mtls", ClientCert: certID})
+		loggerFrom(r.Context()).Debug("Client certificate authenticated", "cert_id", certID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
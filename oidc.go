@@ -0,0 +1,595 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcSessionPrefix   = "oidc:session:"
+	oidcFlowTTL         = 10 * time.Minute
+	oidcJWKSMinInterval = time.Minute // unknown key IDs trigger a JWKS refetch at most this often
+)
+
+// OIDCConfig turns a service into an OpenID Connect relying party, so browsers
+// without a bearer token are sent through the provider's login page
+type OIDCConfig struct {
+	Enabled      bool     `yaml:"enabled"`
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"clientId"`
+	ClientSecret string   `yaml:"clientSecret"`
+	RedirectURL  string   `yaml:"redirectURL"` // absolute callback URL; its path must be under the service path
+	Scopes       []string `yaml:"scopes"`
+	CookieName   string   `yaml:"cookieName"`
+	CookieSecret string   `yaml:"cookieSecret"` // base64 encoded 16, 24 or 32 byte AES key
+	SessionStore string   `yaml:"sessionStore"` // "cookie" (default) or "redis"
+	SessionTTL   string   `yaml:"sessionTTL"`
+}
+
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type oidcTokenResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// oidcSession is what the gateway remembers about a logged in browser
+type oidcSession struct {
+	IDToken      string `json:"idToken"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+}
+
+// oidcFlow carries the state of a login between the redirect and the callback
+type oidcFlow struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	ReturnTo string `json:"returnTo"`
+}
+
+type oidcRelyingParty struct {
+	cfg          OIDCConfig
+	callbackPath string
+	scopes       []string
+	cookieName   string
+	secure       bool
+	sessionTTL   time.Duration
+	aead         cipher.AEAD
+	rdb          redis.UniversalClient // nil unless sessions are stored in Redis
+	client       *http.Client
+
+	mu          sync.Mutex
+	provider    *oidcProviderMetadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+func newOIDCRelyingParty(cfg OIDCConfig, servicePath string, rdb redis.UniversalClient) (*oidcRelyingParty, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, clientId and redirectURL are required")
+	}
+
+	redirectURL, err := url.Parse(cfg.RedirectURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redirectURL: %w", err)
+	}
+	if !strings.HasPrefix(redirectURL.Path, servicePath) {
+		return nil, fmt.Errorf("redirectURL path '%s' is not under the service path '%s'", redirectURL.Path, servicePath)
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(cfg.CookieSecret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookieSecret: %w", err)
+	}
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cookieSecret: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	sessionTTL, err := parseDurationOr(cfg.SessionTTL, 24*time.Hour)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sessionTTL: %w", err)
+	}
+
+	rp := &oidcRelyingParty{
+		cfg:          cfg,
+		callbackPath: redirectURL.Path,
+		scopes:       cfg.Scopes,
+		cookieName:   cfg.CookieName,
+		secure:       redirectURL.Scheme == "https",
+		sessionTTL:   sessionTTL,
+		aead:         aead,
+		client:       &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(rp.scopes) == 0 {
+		rp.scopes = []string{"openid", "profile", "email"}
+	} else if !slices.Contains(rp.scopes, "openid") {
+		rp.scopes = append([]string{"openid"}, rp.scopes...)
+	}
+	if rp.cookieName == "" {
+		rp.cookieName = "hexgate_session"
+	}
+
+	switch cfg.SessionStore {
+	case "", "cookie":
+	case "redis":
+		rp.rdb = rdb
+	default:
+		return nil, fmt.Errorf("unknown sessionStore '%s'", cfg.SessionStore)
+	}
+	return rp, nil
+}
+
+// oidcMiddleware authenticates browsers through an OIDC session. Requests that
+// carry an Authorization header are handed to tokenAuth instead, if configured.
+func oidcMiddleware(next, tokenAuth http.Handler, rp *oidcRelyingParty, revocations *revocationList) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == rp.callbackPath {
+			rp.handleCallback(w, r)
+			return
+		}
+		if tokenAuth != nil && r.Header.Get("Authorization") != "" {
+			tokenAuth.ServeHTTP(w, r)
+			return
+		}
+
+		sess, sessionID, err := rp.loadSession(r)
+		if err != nil {
+			loggerFrom(r.Context()).Info("Ignoring OIDC session", "error", err)
+		}
+		if sess != nil {
+			token, err := rp.verifyIDToken(r.Context(), sess.IDToken)
+			if errors.Is(err, jwt.ErrTokenExpired) && sess.RefreshToken != "" {
+				token, err = rp.refresh(r.Context(), w, sess, sessionID)
+			}
+			if err == nil {
+				stripCookies(r, rp.cookieName, rp.cookieName+"_flow")
+				serveVerifiedToken(w, r, next, token, "oidc", revocations)
+				return
+			}
+			loggerFrom(r.Context()).Info("OIDC session is no longer valid", "error", err)
+		}
+
+		rp.startLogin(w, r)
+	})
+}
+
+func (rp *oidcRelyingParty) startLogin(w http.ResponseWriter, r *http.Request) {
+	// Only browser navigations can follow a login redirect
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		httpError(w, r, "401 Unauthorized: Login required", http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := rp.discover(r.Context())
+	if err != nil {
+		loggerFrom(r.Context()).Error("OIDC discovery failed", "error", err)
+		httpError(w, r, "503 Service Unavailable: Identity provider unavailable", http.StatusServiceUnavailable)
+		return
+	}
+
+	flow := oidcFlow{
+		State:    randomToken(16),
+		Nonce:    randomToken(16),
+		Verifier: randomToken(32),
+		ReturnTo: r.URL.RequestURI(),
+	}
+	if err := rp.setCookie(w, rp.cookieName+"_flow", flow, oidcFlowTTL); err != nil {
+		loggerFrom(r.Context()).Error("Failed to store OIDC login state", "error", err)
+		httpError(w, r, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	challenge := sha256.Sum256([]byte(flow.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {rp.cfg.ClientID},
+		"redirect_uri":          {rp.cfg.RedirectURL},
+		"scope":                 {strings.Join(rp.scopes, " ")},
+		"state":                 {flow.State},
+		"nonce":                 {flow.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+"?"+query.Encode(), http.StatusFound)
+}
+
+func (rp *oidcRelyingParty) handleCallback(w http.ResponseWriter, r *http.Request) {
+	var flow oidcFlow
+	if err := rp.readCookie(r, rp.cookieName+"_flow", &flow); err != nil {
+		loggerFrom(r.Context()).Info("OIDC callback without a valid login state", "error", err)
+		httpError(w, r, "400 Bad Request: Login state missing or expired", http.StatusBadRequest)
+		return
+	}
+	rp.clearCookie(w, rp.cookieName+"_flow")
+
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		loggerFrom(r.Context()).Info("OIDC login failed", "error", e, "description", query.Get("error_description"))
+		httpError(w, r, "401 Unauthorized: Login failed", http.StatusUnauthorized)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(flow.State)) != 1 {
+		httpError(w, r, "400 Bad Request: Invalid login state", http.StatusBadRequest)
+		return
+	}
+
+	tokens, err := rp.exchange(r.Context(), url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {query.Get("code")},
+		"redirect_uri":  {rp.cfg.RedirectURL},
+		"code_verifier": {flow.Verifier},
+	})
+	if err != nil {
+		loggerFrom(r.Context()).Warn("OIDC code exchange failed", "error", err)
+		httpError(w, r, "401 Unauthorized: Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := rp.verifyIDToken(r.Context(), tokens.IDToken)
+	if err != nil {
+		loggerFrom(r.Context()).Info("OIDC ID token rejected", "error", err)
+		httpError(w, r, "401 Unauthorized: Login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	if nonce, _ := claims["nonce"].(string); subtle.ConstantTimeCompare([]byte(nonce), []byte(flow.Nonce)) != 1 {
+		loggerFrom(r.Context()).Info("OIDC ID token nonce mismatch")
+		httpError(w, r, "401 Unauthorized: Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	sess := &oidcSession{IDToken: tokens.IDToken, RefreshToken: tokens.RefreshToken}
+	if err := rp.saveSession(r.Context(), w, sess, ""); err != nil {
+		loggerFrom(r.Context()).Error("Failed to store OIDC session", "error", err)
+		httpError(w, r, "500 Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	returnTo := flow.ReturnTo
+	// Only redirect back to local paths
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") {
+		returnTo = "/"
+	}
+	loggerFrom(r.Context()).Debug("OIDC login completed")
+	http.Redirect(w, r, returnTo, http.StatusFound)
+}
+
+// refresh trades the session's refresh token for a new ID token and stores the updated session
+func (rp *oidcRelyingParty) refresh(ctx context.Context, w http.ResponseWriter, sess *oidcSession, sessionID string) (*jwt.Token, error) {
+	tokens, err := rp.exchange(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {sess.RefreshToken},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token refresh failed: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("token refresh returned no ID token")
+	}
+
+	token, err := rp.verifyIDToken(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	sess.IDToken = tokens.IDToken
+	if tokens.RefreshToken != "" {
+		sess.RefreshToken = tokens.RefreshToken
+	}
+	if err := rp.saveSession(ctx, w, sess, sessionID); err != nil {
+		return nil, err
+	}
+	loggerFrom(ctx).Debug("OIDC session refreshed")
+	return token, nil
+}
+
+func (rp *oidcRelyingParty) discover(ctx context.Context) (*oidcProviderMetadata, error) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.provider != nil {
+		return rp.provider, nil
+	}
+
+	var provider oidcProviderMetadata
+	wellKnown := strings.TrimSuffix(rp.cfg.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := rp.getJSON(ctx, wellKnown, &provider); err != nil {
+		return nil, err
+	}
+	if provider.Issuer != rp.cfg.Issuer {
+		return nil, fmt.Errorf("provider issuer '%s' does not match configured issuer '%s'", provider.Issuer, rp.cfg.Issuer)
+	}
+	rp.provider = &provider
+	return rp.provider, nil
+}
+
+// publicKey returns the provider's signing key with the given ID, refetching the
+// JWKS when the key is unknown (e.g. after a key rotation)
+func (rp *oidcRelyingParty) publicKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	provider, err := rp.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if key := rp.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	if time.Since(rp.keysFetched) < oidcJWKSMinInterval {
+		return nil, fmt.Errorf("unknown signing key '%s'", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	rp.keysFetched = time.Now()
+	if err := rp.getJSON(ctx, provider.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			slog.Warn("Skipping malformed JWKS key", "kid", k.Kid)
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	rp.keys = keys
+
+	if key := rp.lookupKey(kid); key != nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key '%s'", kid)
+}
+
+// lookupKey must be called with rp.mu held. Tokens without a kid are accepted
+// when the provider publishes a single key.
+func (rp *oidcRelyingParty) lookupKey(kid string) *rsa.PublicKey {
+	if key, ok := rp.keys[kid]; ok {
+		return key
+	}
+	if kid == "" && len(rp.keys) == 1 {
+		for _, key := range rp.keys {
+			return key
+		}
+	}
+	return nil
+}
+
+func (rp *oidcRelyingParty) verifyIDToken(ctx context.Context, raw string) (*jwt.Token, error) {
+	provider, err := rp.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return jwt.Parse(raw, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		return rp.publicKey(ctx, kid)
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512"}),
+		jwt.WithIssuer(provider.Issuer),
+		jwt.WithAudience(rp.cfg.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+}
+
+func (rp *oidcRelyingParty) exchange(ctx context.Context, form url.Values) (*oidcTokenResponse, error) {
+	provider, err := rp.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if rp.cfg.ClientSecret == "" {
+		form.Set("client_id", rp.cfg.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if rp.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(rp.cfg.ClientID), url.QueryEscape(rp.cfg.ClientSecret))
+	}
+
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("could not decode token response: %w", err)
+	}
+	return &tokens, nil
+}
+
+func (rp *oidcRelyingParty) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// loadSession returns the session of the request, or nil if there is none.
+// For Redis backed sessions the cookie only holds the session ID.
+func (rp *oidcRelyingParty) loadSession(r *http.Request) (*oidcSession, string, error) {
+	if _, err := r.Cookie(rp.cookieName); err != nil {
+		return nil, "", nil
+	}
+
+	if rp.rdb == nil {
+		var sess oidcSession
+		if err := rp.readCookie(r, rp.cookieName, &sess); err != nil {
+			return nil, "", err
+		}
+		return &sess, "", nil
+	}
+
+	var sessionID string
+	if err := rp.readCookie(r, rp.cookieName, &sessionID); err != nil {
+		return nil, "", err
+	}
+	data, err := rp.rdb.Get(r.Context(), oidcSessionPrefix+sha256Hex(sessionID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to load session: %w", err)
+	}
+	var sess oidcSession
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return nil, "", fmt.Errorf("failed to decode session: %w", err)
+	}
+	return &sess, sessionID, nil
+}
+
+// saveSession stores the session, creating a new session ID when sessionID is empty
+func (rp *oidcRelyingParty) saveSession(ctx context.Context, w http.ResponseWriter, sess *oidcSession, sessionID string) error {
+	if rp.rdb == nil {
+		return rp.setCookie(w, rp.cookieName, sess, rp.sessionTTL)
+	}
+
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return err
+	}
+	newSession := sessionID == ""
+	if newSession {
+		sessionID = randomToken(32)
+	}
+	if err := rp.rdb.Set(ctx, oidcSessionPrefix+sha256Hex(sessionID), data, rp.sessionTTL).Err(); err != nil {
+		return fmt.Errorf("failed to store session: %w", err)
+	}
+	if newSession {
+		return rp.setCookie(w, rp.cookieName, sessionID, rp.sessionTTL)
+	}
+	return nil
+}
+
+// setCookie encrypts v with AES-GCM into a cookie. The expiry is sealed in the
+// payload so a replayed cookie stops working even if the browser keeps it.
+func (rp *oidcRelyingParty) setCookie(w http.ResponseWriter, name string, v interface{}, ttl time.Duration) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	expiresAt := time.Now().Add(ttl)
+	plaintext := binary.BigEndian.AppendUint64(nil, uint64(expiresAt.Unix()))
+	plaintext = append(plaintext, data...)
+
+	nonce := make([]byte, rp.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	sealed := rp.aead.Seal(nonce, nonce, plaintext, []byte(name))
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    base64.RawURLEncoding.EncodeToString(sealed),
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   rp.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+func (rp *oidcRelyingParty) readCookie(r *http.Request, name string, v interface{}) error {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return err
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+	if err != nil || len(sealed) < rp.aead.NonceSize() {
+		return errors.New("malformed cookie")
+	}
+
+	nonceSize := rp.aead.NonceSize()
+	plaintext, err := rp.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], []byte(name))
+	if err != nil || len(plaintext) < 8 {
+		return errors.New("cookie could not be decrypted")
+	}
+	if time.Now().Unix() > int64(binary.BigEndian.Uint64(plaintext[:8])) {
+		return errors.New("cookie expired")
+	}
+	return json.Unmarshal(plaintext[8:], v)
+}
+
+func (rp *oidcRelyingParty) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{Name: name, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, Secure: rp.secure})
+}
+
+// stripCookies removes the gateway's own cookies before the request is proxied
+func stripCookies(r *http.Request, names ...string) {
+	cookies := r.Cookies()
+	r.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !slices.Contains(names, c.Name) {
+			r.AddCookie(c)
+		}
+	}
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// quota:service-override:<service>:<user> and quota:override:<user> are HASHes
+// with limit, period and (optional) burst fields. They replace every window of
+// the user's plan with a single one, on one service or on every quota-enabled
+// service; the service's own override wins. Support staff set them with
+// `hexgatectl quota-override` to change one customer's limit without a config push.
+const (
+	quotaOverridePrefix        = "quota:override:"
+	quotaServiceOverridePrefix = "quota:service-override:"
+	overrideCacheTTL           = 30 * time.Second
+	overridePlanName           = "override"
+	// defaultPlanName labels the service's own limits when no plan applies
+	defaultPlanName = "default"
+)
+
+// PlanConfig is a named quota tier, e.g. "free" or "pro". A plan has either a
+// single limit/period or a list of windows that must all have budget left.
+type PlanConfig struct {
+	Limit   int64         `yaml:"limit"`
+	Period  string        `yaml:"period"`
+	Burst   int64         `yaml:"burst"`
+	Windows []QuotaWindow `yaml:"windows"`
+}
+
+// QuotaWindow is one limit per period, e.g. 1000 per hour
+type QuotaWindow struct {
+	Limit  int64  `yaml:"limit"`
+	Period string `yaml:"period"`
+	Burst  int64  `yaml:"burst"`
+}
+
+// parseWindows turns the single limit/period form or the windows list into rules
+func parseWindows(limit int64, period string, burst int64, windows []QuotaWindow) ([]quotaRule, error) {
+	if len(windows) == 0 {
+		if period == "" {
+			return nil, nil
+		}
+		windows = []QuotaWindow{{Limit: limit, Period: period, Burst: burst}}
+	}
+
+	rules := make([]quotaRule, 0, len(windows))
+	for _, w := range windows {
+		d, err := time.ParseDuration(w.Period)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period '%s': %w", w.Period, err)
+		}
+		if w.Limit <= 0 || d <= 0 {
+			return nil, fmt.Errorf("window %d per %s: limit and period must be positive", w.Limit, w.Period)
+		}
+		// Windows are stored under a key per period, so two of them would share state
+		for _, rule := range rules {
+			if rule.Period == d {
+				return nil, fmt.Errorf("more than one window per %s", d)
+			}
+		}
+		rules = append(rules, quotaRule{Limit: w.Limit, Period: d, Burst: w.Burst})
+	}
+	return rules, nil
+}
+
+// quotaPolicy picks the quota rule for a request: a per-user override from
+// Redis, the plan named by the caller's claims or API key metadata, or the
+// service's default limit
+type quotaPolicy struct {
+	defaultRules []quotaRule
+	plans        map[string][]quotaRule
+	planClaim    string
+	defaultPlan  string
+	overrides    *overrideCache
+}
+
+func newQuotaPolicy(serviceName string, cfg QuotaConfig, plans map[string]PlanConfig, rdb redis.UniversalClient) (*quotaPolicy, error) {
+	policy := &quotaPolicy{
+		plans:       make(map[string][]quotaRule, len(plans)),
+		planClaim:   cfg.PlanClaim,
+		defaultPlan: cfg.DefaultPlan,
+		overrides:   newOverrideCache(serviceName, rdb),
+	}
+
+	var err error
+	policy.defaultRules, err = parseWindows(cfg.Limit, cfg.Period, cfg.Burst, cfg.Windows)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, plan := range plans {
+		rules, err := parseWindows(plan.Limit, plan.Period, plan.Burst, plan.Windows)
+		if err != nil {
+			return nil, fmt.Errorf("plan '%s': %w", name, err)
+		}
+		if len(rules) == 0 {
+			return nil, fmt.Errorf("plan '%s' has no limit", name)
+		}
+		policy.plans[name] = rules
+	}
+
+	if policy.defaultPlan != "" {
+		rules, ok := policy.plans[policy.defaultPlan]
+		if !ok {
+			return nil, fmt.Errorf("default plan '%s' is not defined", policy.defaultPlan)
+		}
+		policy.defaultRules = rules
+	}
+	if len(policy.defaultRules) == 0 {
+		return nil, errors.New("quota needs a limit and period, windows, or a default plan")
+	}
+	return policy, nil
+}
+
+// planFor returns the name of the caller's plan, or "" if the default applies
+func (p *quotaPolicy) planFor(id *Identity) string {
+	if p.planClaim == "" || id == nil {
+		return p.defaultPlan
+	}
+
+	plan := planOf(id, p.planClaim)
+	if _, ok := p.plans[plan]; !ok {
+		return p.defaultPlan
+	}
+	return plan
+}
+
+// rulesFor returns the windows to apply to a user and the name of the plan they
+// came from, "default" for the service's own limits. An override replaces all
+// windows of the plan.
+func (p *quotaPolicy) rulesFor(ctx context.Context, id *Identity) ([]quotaRule, string) {
+	if id != nil && id.Subject != "" {
+		if rule, ok := p.overrides.get(ctx, id.Subject); ok {
+			return []quotaRule{rule}, overridePlanName
+		}
+	}
+
+	plan := p.planFor(id)
+	if rules, ok := p.plans[plan]; ok {
+		return rules, plan
+	}
+	return p.defaultRules, orDefaultPlan(plan)
+}
+
+// rulesForPlan is rulesFor with the plan named explicitly, for the admin API.
+// An empty plan means the service default. ok is false for unknown plans.
+func (p *quotaPolicy) rulesForPlan(ctx context.Context, userID, plan string) ([]quotaRule, string, bool) {
+	if userID != "" {
+		if rule, ok := p.overrides.get(ctx, userID); ok {
+			return []quotaRule{rule}, overridePlanName, true
+		}
+	}
+	if plan == "" {
+		return p.defaultRules, orDefaultPlan(p.defaultPlan), true
+	}
+	rules, ok := p.plans[plan]
+	return rules, plan, ok
+}
+
+// orDefaultPlan keeps metric labels and logs from carrying an empty plan
+func orDefaultPlan(plan string) string {
+	if plan == "" {
+		return defaultPlanName
+	}
+	return plan
+}
+
+// smallestWindow returns the window of the default rules or a plan that admits
+// the smallest cost, and the name of its plan
+func (p *quotaPolicy) smallestWindow(algorithm string) (string, quotaRule, bool) {
+	var plan string
+	var smallest quotaRule
+	found := false
+	check := func(name string, rules []quotaRule) {
+		for _, rule := range rules {
+			if !found || rule.capacity(algorithm) < smallest.capacity(algorithm) {
+				plan, smallest, found = name, rule, true
+			}
+		}
+	}
+	check(orDefaultPlan(p.defaultPlan), p.defaultRules)
+	for name, rules := range p.plans {
+		check(name, rules)
+	}
+	return plan, smallest, found
+}
+
+// periods returns every window period used by the default rules and the plans
+func (p *quotaPolicy) periods() []time.Duration {
+	var periods []time.Duration
+	add := func(rules []quotaRule) {
+		for _, rule := range rules {
+			if !slices.Contains(periods, rule.Period) {
+				periods = append(periods, rule.Period)
+			}
+		}
+	}
+	add(p.defaultRules)
+	for _, rules := range p.plans {
+		add(rules)
+	}
+	return periods
+}
+
+type cachedOverride struct {
+	rule      quotaRule
+	found     bool
+	expiresAt time.Time
+}
+
+// overrideCache keeps per-user overrides in memory for a short while, so the
+// common case (no override) does not add a Redis round trip to every request
+type overrideCache struct {
+	service string
+	rdb     redis.UniversalClient
+
+	mu      sync.Mutex
+	entries map[string]cachedOverride
+}
+
+func newOverrideCache(service string, rdb redis.UniversalClient) *overrideCache {
+	return &overrideCache{service: service, rdb: rdb, entries: make(map[string]cachedOverride)}
+}
+
+func (c *overrideCache) get(ctx context.Context, userID string) (quotaRule, bool) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.rule, entry.found
+	}
+	if !redisBreaker.Closed() {
+		// Redis is down, keep serving the last known override if there is one
+		return entry.rule, entry.found
+	}
+
+	entry = cachedOverride{expiresAt: now.Add(overrideCacheTTL)}
+	pipe := c.rdb.Pipeline()
+	scoped := pipe.HGetAll(ctx, quotaServiceOverridePrefix+c.service+":"+userID)
+	global := pipe.HGetAll(ctx, quotaOverridePrefix+userID)
+	_, err := pipe.Exec(ctx)
+	fields := scoped.Val()
+	if len(fields) == 0 {
+		fields = global.Val()
+	}
+	if err != nil {
+		// Fall back to the plan rather than failing the request
+		loggerFrom(ctx).Warn("Failed to read quota override", "user", userID, "error", err)
+		return quotaRule{}, false
+	}
+	if len(fields) > 0 {
+		rule, err := parseOverride(fields)
+		if err != nil {
+			loggerFrom(ctx).Warn("Ignoring invalid quota override", "user", userID, "error", err)
+		} else {
+			entry.rule = rule
+			entry.found = true
+		}
+	}
+
+	c.mu.Lock()
+	// Drop expired entries once the map gets large
+	if len(c.entries) >= 10000 {
+		for k, v := range c.entries {
+			if now.After(v.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[userID] = entry
+	c.mu.Unlock()
+	return entry.rule, entry.found
+}
+
+func parseOverride(fields map[string]string) (quotaRule, error) {
+	var rule quotaRule
+	var err error
+	if rule.Limit, err = strconv.ParseInt(fields["limit"], 10, 64); err != nil {
+		return rule, fmt.Errorf("invalid limit: %w", err)
+	}
+	if rule.Period, err = time.ParseDuration(fields["period"]); err != nil {
+		return rule, fmt.Errorf("invalid period: %w", err)
+	}
+	if burst, ok := fields["burst"]; ok && burst != "" {
+		if rule.Burst, err = strconv.ParseInt(burst, 10, 64); err != nil {
+			return rule, fmt.Errorf("invalid burst: %w", err)
+		}
+	}
+	if rule.Limit <= 0 || rule.Period <= 0 {
+		return rule, errors.New("limit and period must be positive")
+	}
+	return rule, nil
+}
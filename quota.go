@@ -1,67 +1,246 @@
 package main
 
 import (
-	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/redis/go-redis/v9"
-	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
 type QuotaConfig struct {
-	Enabled bool   `yaml:"enabled"`
-	Limit   int64  `yaml:"limit"`
-	Period  string `yaml:"period"`
+	Enabled     bool          `yaml:"enabled"`
+	Algorithm   string        `yaml:"algorithm"` // sliding-log (default), sliding-window, fixed-window, token-bucket or gcra
+	Limit       int64         `yaml:"limit"`
+	Period      string        `yaml:"period"`
+	Burst       int64         `yaml:"burst"`       // token-bucket and gcra only, defaults to limit
+	Windows     []QuotaWindow `yaml:"windows"`     // several limits that must all hold, instead of limit/period
+	PlanClaim   string        `yaml:"planClaim"`   // JWT claim or API key metadata field naming the caller's plan
+	DefaultPlan string        `yaml:"defaultPlan"` // plan used when the caller has none; overrides limit/period
+	Key         string        `yaml:"key"`         // what the quota is counted against, see quotaKeyTemplate; defaults to "{user}"
+	// OnRedisFailure decides what happens when Redis cannot be reached: closed
+	// (default) rejects with 503, open lets requests through, local enforces the
+	// quota in memory with every limit divided by Gateways
+	OnRedisFailure string `yaml:"onRedisFailure"`
+	Gateways       int64  `yaml:"gateways"` // estimated number of gateway instances, for the local fallback
+	// Costs weighs expensive endpoints; a request consumes its cost in quota
+	// units from every window. CostHeader names a backend response header
+	// reporting the real cost, of which anything above the upfront cost is
+	// charged after the fact. The header is removed before the response
+	// reaches the client.
+	Costs      []CostRule `yaml:"costs"`
+	CostHeader string     `yaml:"costHeader"`
+	// Shadow evaluates and counts the quota but forwards over-limit requests,
+	// only logging them and counting hexgate_quota_would_reject_total. No
+	// RateLimit headers are sent, and Redis failures always fail open.
+	Shadow bool `yaml:"shadow"`
 }
 
-func quotaMiddleware(next http.Handler, cfg QuotaConfig, rdb *redis.Client) http.Handler {
-	period, err := time.ParseDuration(cfg.Period)
+const (
+	failClosed = "closed"
+	failOpen   = "open"
+	failLocal  = "local"
+)
+
+// quotaKeys returns the Redis keys holding the quota state of a rendered quota
+// key, one per window: quota:{<algorithm>:<key>}:<period>. Windows are keyed by
+// period, so a plan change keeps the usage of windows both plans share. The hash
+// tag puts all windows in the same Redis Cluster slot, as the scripts need.
+func quotaKeys(algorithm, key string, rules []quotaRule) []string {
+	keys := make([]string, len(rules))
+	for i, rule := range rules {
+		keys[i] = fmt.Sprintf("quota:{%s:%s}:%s", algorithm, key, rule.Period)
+	}
+	return keys
+}
+
+// quotaBonusKeys returns the keys of the bonus units granted to each window,
+// in the same slot as the window
+func quotaBonusKeys(keys []string) []string {
+	bonusKeys := make([]string, len(keys))
+	for i, key := range keys {
+		bonusKeys[i] = key + ":bonus"
+	}
+	return bonusKeys
+}
+
+func quotaMiddleware(next http.Handler, serviceName string, cfg QuotaConfig, plans map[string]PlanConfig, ips *ipResolver, rdb redis.UniversalClient, quotas map[string]*serviceQuota) (http.Handler, error) {
+	policy, err := newQuotaPolicy(serviceName, cfg, plans, rdb)
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := newRateLimiter(cfg.Algorithm, rdb)
+	if err != nil {
+		return nil, err
+	}
+	keyTemplate, err := parseQuotaKey(cfg.Key)
 	if err != nil {
-		log.Fatalf("Invalid quota period '%s': %v", cfg.Period, err)
+		return nil, err
+	}
+	failureMode := cfg.OnRedisFailure
+	switch failureMode {
+	case "":
+		failureMode = failClosed
+	case failClosed, failOpen, failLocal:
+	default:
+		return nil, fmt.Errorf("unknown onRedisFailure mode '%s'", failureMode)
+	}
+	if err := validateCostRules(cfg.Costs, policy, limiter.algorithm); err != nil {
+		return nil, err
+	}
+	fallback := newLocalLimiter(cfg.Gateways)
+	quotas[serviceName] = &serviceQuota{limiter: limiter, policy: policy}
+
+	// consume runs the quota scripts, or the local limiter if Redis is down and
+	// the failure mode allows it
+	consume := func(r *http.Request, key string, rules []quotaRule, cost int64, force bool) (quotaDecision, error) {
+		err := errCircuitOpen
+		if redisBreaker.Allow() {
+			var decision quotaDecision
+			keys := quotaKeys(limiter.algorithm, key, rules)
+			if force {
+				decision, err = limiter.Charge(r.Context(), keys, rules, cost)
+			} else {
+				decision, err = limiter.Allow(r.Context(), keys, rules, cost)
+			}
+			redisBreaker.Record(err)
+			if err == nil {
+				return decision, nil
+			}
+		}
+
+		quotaFallbackTotal.WithLabelValues(serviceName, failureMode).Inc()
+		if err != errCircuitOpen {
+			loggerFrom(r.Context()).Warn("Redis quota script failed, applying failure mode", "mode", failureMode, "error", err)
+		}
+		if failureMode == failLocal {
+			return fallback.Allow(key, rules, cost, force), nil
+		}
+		return quotaDecision{}, err
 	}
-	periodMillis := period.Milliseconds()
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Get the User ID from the context (set by jwtAuthMiddleware)
-		userID, ok := r.Context().Value(userIDKey).(string)
-		if !ok || userID == "" {
-			log.Println("Quota check failed: User ID not found in context.")
-			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		key, err := keyTemplate.render(r, serviceName, ips)
+		if err != nil {
+			writeKeyError(w, r, "Quota", cfg.Key, err)
 			return
 		}
 
-		ctx := context.Background()
-		now := time.Now().UnixNano() / int64(time.Millisecond) // Score
-		minTime := now - periodMillis
-		key := fmt.Sprintf("quota:%s", userID) // Redis key per user
-		member := strconv.FormatInt(now, 10)
-
-		var count int64
-		pipe := rdb.TxPipeline()
-		// Remove all old requests (timestamps) from the set
-		pipe.ZRemRangeByScore(ctx, key, "0", strconv.FormatInt(minTime, 10))
-		// Add the new request (timestamp) to the set
-		pipe.ZAdd(ctx, key, redis.Z{Score: float64(now), Member: member})
-		// Count how many requests are in the window [minTime-now]
-		countCmd := pipe.ZCard(ctx, key)
-		// Set the set to expire to clean up old users
-		pipe.PExpire(ctx, key, period)
-
-		if _, err := pipe.Exec(ctx); err != nil {
-			log.Printf("Redis transaction failed: %v", err)
-			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+		identity, _ := identityFromContext(r.Context())
+		rules, plan := policy.rulesFor(r.Context(), identity)
+
+		cost := requestCost(cfg.Costs, r)
+		rec := accessRecordFrom(r.Context())
+		decision, err := consume(r, key, rules, cost, false)
+		if err != nil {
+			if failureMode == failOpen || cfg.Shadow {
+				rec.setQuota("fail-open")
+				next.ServeHTTP(w, r)
+				return
+			}
+			rec.setQuota("fail-closed")
+			httpError(w, r, "503 Service Unavailable", http.StatusServiceUnavailable)
 			return
 		}
-		count = countCmd.Val()
 
-		if count > cfg.Limit {
-			log.Printf("Quota exceeded for user %s: %d/%d", userID, count, cfg.Limit)
-			http.Error(w, "429 Too Many Requests", http.StatusTooManyRequests)
+		if !decision.Allowed {
+			tripped := decision.Windows[decision.Tripped]
+			if cfg.Shadow {
+				loggerFrom(r.Context()).Info("Quota shadow mode: would reject", "quota_key", key, "plan", plan, "limit", tripped.Limit, "period", tripped.Period.String())
+				quotaWouldRejectTotal.WithLabelValues(serviceName, plan).Inc()
+				rec.setQuota("would-reject")
+				next.ServeHTTP(w, r)
+				return
+			}
+			setRateLimitHeaders(w.Header(), decision)
+			loggerFrom(r.Context()).Info("Quota exceeded", "quota_key", key, "plan", plan, "limit", tripped.Limit, "period", tripped.Period.String())
+			rec.setQuota("rejected")
+			writeQuotaExceeded(w, r, tripped)
 			return
 		}
+		rec.setQuota("allowed")
+		if !cfg.Shadow {
+			setRateLimitHeaders(w.Header(), decision)
+		}
+		quotaUnitsTotal.WithLabelValues(serviceName, plan).Add(float64(cost))
+		quotaUsage.record(serviceName, key, cost)
 
+		if cfg.CostHeader != "" {
+			w = &costResponseWriter{ResponseWriter: w, header: cfg.CostHeader, charge: func(actual int64) {
+				if actual <= cost {
+					return
+				}
+				decision, err := consume(r, key, rules, actual-cost, true)
+				if err != nil {
+					loggerFrom(r.Context()).Warn("Failed to charge extra quota units", "quota_key", key, "units", actual-cost, "error", err)
+					return
+				}
+				if !cfg.Shadow {
+					setRateLimitHeaders(w.Header(), decision)
+				}
+				quotaUnitsTotal.WithLabelValues(serviceName, plan).Add(float64(actual - cost))
+				quotaUsage.record(serviceName, key, actual-cost)
+			}}
+		}
 		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// writeKeyError answers a request whose quota or concurrency key could not be
+// built: 400 if it lacks a header the key uses, 500 otherwise
+func writeKeyError(w http.ResponseWriter, r *http.Request, check, key string, err error) {
+	var missing *missingKeyHeaderError
+	if errors.As(err, &missing) {
+		loggerFrom(r.Context()).Info(check+" check failed: request lacks a key header", "key", key, "header", missing.header)
+		httpError(w, r, "400 Bad Request: Missing "+missing.header+" header", http.StatusBadRequest)
+		return
+	}
+	loggerFrom(r.Context()).Error(check+" check failed: could not build key", "key", key, "error", err)
+	httpError(w, r, "500 Internal Server Error", http.StatusInternalServerError)
+}
+
+// setRateLimitHeaders emits the IETF RateLimit headers. Limit, Remaining and
+// Reset describe the most restrictive window (the one that rejected the request,
+// or the one with the least budget left); RateLimit-Policy lists every window.
+func setRateLimitHeaders(h http.Header, decision quotaDecision) {
+	current := decision.Tripped
+	policies := make([]string, len(decision.Windows))
+	for i, window := range decision.Windows {
+		policies[i] = fmt.Sprintf("%d;w=%d", window.Limit, ceilSeconds(window.Period))
+		if current < 0 || (decision.Allowed && window.Remaining < decision.Windows[current].Remaining) {
+			current = i
+		}
+	}
+
+	window := decision.Windows[current]
+	h.Set("RateLimit-Limit", strconv.FormatInt(window.Limit, 10))
+	h.Set("RateLimit-Remaining", strconv.FormatInt(window.Remaining, 10))
+	h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(window.ResetAfter), 10))
+	h.Set("RateLimit-Policy", strings.Join(policies, ", "))
+}
+
+// writeQuotaExceeded writes a 429 with Retry-After and an RFC 9457 problem body
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, tripped limitResult) {
+	retryAfter := max(ceilSeconds(tripped.RetryAfter), 1)
+	w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"type":       "about:blank",
+		"title":      "Too Many Requests",
+		"status":     http.StatusTooManyRequests,
+		"detail":     fmt.Sprintf("Quota of %d units per %s exceeded", tripped.Limit, tripped.Period),
+		"limit":      tripped.Limit,
+		"window":     ceilSeconds(tripped.Period),
+		"retryAfter": retryAfter,
+		"requestId":  requestIDFrom(r.Context()),
 	})
 }
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// quota:top:{<service>}:<YYYY-MM-DD> is a ZSET of quota key -> units consumed
+// that day (UTC), fed by the usageTracker
+const (
+	quotaTopPrefix     = "quota:top:"
+	usageFlushInterval = 10 * time.Second
+	usageRetention     = 8 * 24 * time.Hour
+)
+
+// serviceQuota is the quota setup of a service, kept by the router it was built
+// for so the admin API always sees the active configuration
+type serviceQuota struct {
+	limiter *rateLimiter
+	policy  *quotaPolicy
+}
+
+// usageTracker sums quota units per service and key in memory and adds them
+// to the daily top consumer sets in Redis every few seconds, so tracking does
+// not cost a round trip per request
+type usageTracker struct {
+	rdb redis.UniversalClient
+
+	mu      sync.Mutex
+	pending map[string]map[string]int64 // service -> quota key -> units
+}
+
+func newUsageTracker(rdb redis.UniversalClient) *usageTracker {
+	return &usageTracker{rdb: rdb, pending: make(map[string]map[string]int64)}
+}
+
+// record adds consumed units. It is a no-op on a nil tracker.
+func (u *usageTracker) record(service, key string, units int64) {
+	if u == nil || units == 0 {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.pending[service] == nil {
+		u.pending[service] = make(map[string]int64)
+	}
+	u.pending[service][key] += units
+}
+
+func (u *usageTracker) start(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := u.flush(context.Background()); err != nil {
+				slog.Warn("Failed to flush quota usage", "error", err)
+			}
+		}
+	}()
+}
+
+func (u *usageTracker) flush(ctx context.Context) error {
+	if !redisBreaker.Closed() {
+		// Keep accumulating until Redis is back
+		return nil
+	}
+
+	u.mu.Lock()
+	pending := u.pending
+	u.pending = make(map[string]map[string]int64)
+	u.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	day := time.Now().UTC()
+	pipe := u.rdb.Pipeline()
+	for service, keys := range pending {
+		topKey := quotaTopKey(service, day)
+		for key, units := range keys {
+			pipe.ZIncrBy(ctx, topKey, float64(units), key)
+		}
+		pipe.Expire(ctx, topKey, usageRetention)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func quotaTopKey(service string, day time.Time) string {
+	return fmt.Sprintf("%s{%s}:%s", quotaTopPrefix, service, day.Format(time.DateOnly))
+}
+
+// quotaWindowView is the admin representation of one quota window
+type quotaWindowView struct {
+	Limit      int64  `json:"limit"`
+	Period     string `json:"period"`
+	Used       int64  `json:"used"`
+	Remaining  int64  `json:"remaining"` // including the bonus
+	Bonus      int64  `json:"bonus"`
+	ResetAfter int64  `json:"resetAfter"` // seconds
+}
+
+func windowViews(decision quotaDecision) []quotaWindowView {
+	views := make([]quotaWindowView, len(decision.Windows))
+	for i, w := range decision.Windows {
+		views[i] = quotaWindowView{
+			Limit:      w.Limit,
+			Period:     w.Period.String(),
+			Used:       max(w.Limit-(w.Remaining-w.Bonus), 0),
+			Remaining:  w.Remaining,
+			Bonus:      w.Bonus,
+			ResetAfter: ceilSeconds(w.ResetAfter),
+		}
+	}
+	return views
+}
+
+// adminServiceQuota looks up the service named in the request path, writing a
+// 404 if it has no quota
+func adminServiceQuota(w http.ResponseWriter, r *http.Request, router *atomic.Value) (*serviceQuota, bool) {
+	sq, ok := router.Load().(*gatewayRouter).quotas[r.PathValue("service")]
+	if !ok {
+		http.Error(w, "404 Not Found: Service has no quota", http.StatusNotFound)
+		return nil, false
+	}
+	return sq, true
+}
+
+// quotaTarget names the quota an admin request is about. Key is the rendered
+// quota key and defaults to User, which matches the default "{user}" key.
+type quotaTarget struct {
+	Key  string `json:"key"`
+	User string `json:"user"` // applies the user's override, if any
+	Plan string `json:"plan"` // defaults to the service's default plan or limits
+}
+
+func (t *quotaTarget) resolve(ctx context.Context, sq *serviceQuota) ([]quotaRule, string, error) {
+	if t.Key == "" {
+		t.Key = t.User
+	}
+	if t.Key == "" {
+		return nil, "", fmt.Errorf("key or user is required")
+	}
+	rules, plan, ok := sq.policy.rulesForPlan(ctx, t.User, t.Plan)
+	if !ok {
+		return nil, "", fmt.Errorf("unknown plan '%s'", t.Plan)
+	}
+	return rules, plan, nil
+}
+
+func quotaUsageHandler(router *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sq, ok := adminServiceQuota(w, r, router)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		target := quotaTarget{Key: q.Get("key"), User: q.Get("user"), Plan: q.Get("plan")}
+		rules, plan, err := target.resolve(r.Context(), sq)
+		if err != nil {
+			http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		decision, err := sq.limiter.Peek(r.Context(), quotaKeys(sq.limiter.algorithm, target.Key, rules), rules, 1)
+		if err != nil {
+			slog.Error("Failed to read quota usage", "quota_key", target.Key, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"service":   r.PathValue("service"),
+			"key":       target.Key,
+			"plan":      plan,
+			"algorithm": sq.limiter.algorithm,
+			"allowed":   decision.Allowed,
+			"windows":   windowViews(decision),
+		})
+	}
+}
+
+func quotaResetHandler(router *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sq, ok := adminServiceQuota(w, r, router)
+		if !ok {
+			return
+		}
+		var target quotaTarget
+		if err := json.NewDecoder(r.Body).Decode(&target); err != nil || (target.Key == "" && target.User == "") {
+			http.Error(w, "400 Bad Request: expected {\"key\": ...} or {\"user\": ...}", http.StatusBadRequest)
+			return
+		}
+		if target.Key == "" {
+			target.Key = target.User
+		}
+
+		// Reset every window the key may have, whatever plan it was counted under
+		rules := make([]quotaRule, 0)
+		for _, period := range sq.policy.periods() {
+			rules = append(rules, quotaRule{Period: period})
+		}
+		if target.User != "" {
+			if rule, ok := sq.policy.overrides.get(r.Context(), target.User); ok {
+				rules = append(rules, rule)
+			}
+		}
+		keys := quotaKeys(sq.limiter.algorithm, target.Key, rules)
+
+		// All windows share the hash tag, so one DEL works on Redis Cluster too
+		deleted, err := sq.limiter.rdb.Del(r.Context(), keys...).Result()
+		if err != nil {
+			slog.Error("Failed to reset quota", "quota_key", target.Key, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Reset quota", "quota_key", target.Key, "service", r.PathValue("service"), "windows", deleted)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"key": target.Key, "deleted": deleted})
+	}
+}
+
+// quotaBonusHandler grants one-off units on top of every window of a key. A
+// window's bonus lasts for one period of the window and is only used once the
+// window itself would reject a request, so it can take a customer past their
+// limit. Granting again adds to the bonus and restarts its period.
+func quotaBonusHandler(router *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sq, ok := adminServiceQuota(w, r, router)
+		if !ok {
+			return
+		}
+		var req struct {
+			quotaTarget
+			Units int64 `json:"units"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Units <= 0 {
+			http.Error(w, "400 Bad Request: expected {\"key\": ..., \"units\": ...}", http.StatusBadRequest)
+			return
+		}
+		rules, plan, err := req.resolve(r.Context(), sq)
+		if err != nil {
+			http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		keys := quotaKeys(sq.limiter.algorithm, req.Key, rules)
+		// All windows share the hash tag, so the transaction works on Redis Cluster too
+		pipe := sq.limiter.rdb.TxPipeline()
+		for i, bonusKey := range quotaBonusKeys(keys) {
+			pipe.IncrBy(r.Context(), bonusKey, req.Units)
+			pipe.PExpire(r.Context(), bonusKey, rules[i].Period)
+		}
+		if _, err := pipe.Exec(r.Context()); err != nil {
+			slog.Error("Failed to grant quota bonus", "quota_key", req.Key, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		decision, err := sq.limiter.Peek(r.Context(), keys, rules, 1)
+		if err != nil {
+			slog.Error("Failed to read quota usage", "quota_key", req.Key, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Granted bonus quota units", "quota_key", req.Key, "service", r.PathValue("service"), "units", req.Units)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"key":     req.Key,
+			"plan":    plan,
+			"windows": windowViews(decision),
+		})
+	}
+}
+
+// quotaRefundHandler gives back units a key has consumed in its current
+// windows, e.g. for requests that failed on our side. It cannot raise a window
+// above its full budget: a token bucket stops at its burst, GCRA at a fresh
+// start and the other algorithms at zero usage. Use a bonus to go beyond it.
+func quotaRefundHandler(router *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sq, ok := adminServiceQuota(w, r, router)
+		if !ok {
+			return
+		}
+		var req struct {
+			quotaTarget
+			Units int64 `json:"units"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Units <= 0 {
+			http.Error(w, "400 Bad Request: expected {\"key\": ..., \"units\": ...}", http.StatusBadRequest)
+			return
+		}
+		rules, plan, err := req.resolve(r.Context(), sq)
+		if err != nil {
+			http.Error(w, "400 Bad Request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// A negative charge refunds units in the current window of every rule
+		decision, err := sq.limiter.Charge(r.Context(), quotaKeys(sq.limiter.algorithm, req.Key, rules), rules, -req.Units)
+		if err != nil {
+			slog.Error("Failed to refund quota units", "quota_key", req.Key, "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		slog.Info("Refunded quota units", "quota_key", req.Key, "service", r.PathValue("service"), "units", req.Units)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"key":     req.Key,
+			"plan":    plan,
+			"windows": windowViews(decision),
+		})
+	}
+}
+
+func quotaTopHandler(router *atomic.Value) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sq, ok := adminServiceQuota(w, r, router)
+		if !ok {
+			return
+		}
+		q := r.URL.Query()
+		n, err := strconv.ParseInt(q.Get("n"), 10, 64)
+		if err != nil || n <= 0 {
+			n = 10
+		}
+		day := time.Now().UTC()
+		if d := q.Get("date"); d != "" {
+			if day, err = time.Parse(time.DateOnly, d); err != nil {
+				http.Error(w, "400 Bad Request: date must be YYYY-MM-DD", http.StatusBadRequest)
+				return
+			}
+		}
+
+		top, err := sq.limiter.rdb.ZRevRangeWithScores(r.Context(), quotaTopKey(r.PathValue("service"), day), 0, n-1).Result()
+		if err != nil {
+			slog.Error("Failed to read top quota consumers", "error", err)
+			http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		type consumer struct {
+			Key   string `json:"key"`
+			Units int64  `json:"units"`
+		}
+		consumers := make([]consumer, len(top))
+		for i, z := range top {
+			consumers[i] = consumer{Key: z.Member.(string), Units: int64(z.Score)}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"service":   r.PathValue("service"),
+			"date":      day.Format(time.DateOnly),
+			"consumers": consumers,
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const defaultQuotaKey = "{user}"
+
+// missingKeyHeaderError is returned by render when the request lacks a header
+// used by a {header:Name} part, which is the client's fault
+type missingKeyHeaderError struct {
+	header string
+}
+
+func (e *missingKeyHeaderError) Error() string {
+	return "missing header " + e.header
+}
+
+// quotaKeyTemplate builds the identity a quota is counted against from parts
+// of the request. Placeholders:
+//
+//	{service}        service name
+//	{route}          path pattern the service is registered at
+//	{method}, {path} request method and URL path (per endpoint quotas)
+//	{user}           authenticated subject
+//	{ip}             client IP (see trustedProxies)
+//	{apikey}         ID of the API key used
+//	{cert}           identity of the client certificate
+//	{header:Name}    value of a request header, e.g. {header:X-Tenant}; the
+//	                 client chooses it, so only use headers set by a trusted
+//	                 proxy or checked by the backend
+//	{claim:name}     value of a token claim, e.g. {claim:tenant}
+//
+// For example "{service}:{user}" gives every user a separate quota per
+// service, while "{ip}" applies to unauthenticated traffic.
+type quotaKeyTemplate struct {
+	parts []keyPart
+}
+
+type keyPart struct {
+	literal string
+	kind    string // placeholder name, empty for literals
+	arg     string
+}
+
+var quotaKeyPlaceholders = map[string]bool{
+	"service": true, "route": true, "method": true, "path": true, "user": true,
+	"ip": true, "apikey": true, "cert": true, "header": true, "claim": true,
+}
+
+func parseQuotaKey(tmpl string) (*quotaKeyTemplate, error) {
+	if tmpl == "" {
+		tmpl = defaultQuotaKey
+	}
+
+	t := &quotaKeyTemplate{}
+	for rest := tmpl; rest != ""; {
+		start := strings.IndexByte(rest, '{')
+		if start < 0 {
+			t.parts = append(t.parts, keyPart{literal: rest})
+			break
+		}
+		if start > 0 {
+			t.parts = append(t.parts, keyPart{literal: rest[:start]})
+		}
+		end := strings.IndexByte(rest[start:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated placeholder in quota key '%s'", tmpl)
+		}
+
+		kind, arg, _ := strings.Cut(rest[start+1:start+end], ":")
+		if !quotaKeyPlaceholders[kind] {
+			return nil, fmt.Errorf("unknown placeholder '{%s}' in quota key '%s'", kind, tmpl)
+		}
+		if (kind == "header" || kind == "claim") && arg == "" {
+			return nil, fmt.Errorf("placeholder '{%s}' needs a name, e.g. {%s:tenant}", kind, kind)
+		}
+		t.parts = append(t.parts, keyPart{kind: kind, arg: arg})
+		rest = rest[start+end+1:]
+	}
+	return t, nil
+}
+
+// needsIdentity reports whether the key can only be built for authenticated requests
+func (t *quotaKeyTemplate) needsIdentity() bool {
+	for _, p := range t.parts {
+		switch p.kind {
+		case "user", "apikey", "cert", "claim":
+			return true
+		}
+	}
+	return false
+}
+
+// render builds the key for a request. It fails if a part the key depends on
+// is missing, e.g. {user} on an unauthenticated request, with a
+// *missingKeyHeaderError for a missing header. Requests without the header must
+// not share one key, or they would all count against the same budget.
+func (t *quotaKeyTemplate) render(r *http.Request, serviceName string, ips *ipResolver) (string, error) {
+	identity, _ := identityFromContext(r.Context())
+
+	var b strings.Builder
+	for _, p := range t.parts {
+		var value string
+		switch p.kind {
+		case "":
+			value = p.literal
+		case "service":
+			value = serviceName
+		case "route":
+			value = r.Pattern
+		case "method":
+			value = r.Method
+		case "path":
+			value = r.URL.Path
+		case "ip":
+			value = ips.clientIP(r)
+		case "header":
+			value = r.Header.Get(p.arg)
+		case "user":
+			if identity != nil {
+				value = identity.Subject
+			}
+		case "apikey":
+			if identity != nil {
+				value = identity.KeyID
+			}
+		case "cert":
+			if identity != nil {
+				value = identity.ClientCert
+			}
+		case "claim":
+			if identity != nil && identity.Claims[p.arg] != nil {
+				value = fmt.Sprint(identity.Claims[p.arg])
+			}
+		}
+		if value == "" {
+			if p.kind == "header" {
+				return "", &missingKeyHeaderError{header: p.arg}
+			}
+			return "", fmt.Errorf("'{%s}' is not available for the request", p.kind)
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"slices"
+	"time"
+)
+
+const (
+	algorithmSlidingLog    = "sliding-log"
+	algorithmSlidingWindow = "sliding-window"
+	algorithmFixedWindow   = "fixed-window"
+	algorithmTokenBucket   = "token-bucket"
+	algorithmGCRA          = "gcra"
+)
+
+// Every script checks several windows (one key each) in a single round trip and
+// only consumes budget if all of them accept the request. They read the clock
+// from Redis, so gateway instances with skewed clocks still agree on the window.
+//
+// Each window may also have a bonus: units granted through the admin API on top
+// of its limit, kept under <state key>:bonus until they are used up or the
+// window's period has passed. A window that would reject a request admits it
+// if the bonus covers the whole cost, and the cost is taken from the bonus
+// instead of the window's own state.
+//
+//	KEYS[i]         state key of window i (1 <= i <= n, n = #KEYS / 2)
+//	KEYS[n+i]       bonus key of window i
+//	ARGV[1]         unique request ID
+//	ARGV[2]         cost of the request in quota units
+//	ARGV[3]         mode: check (consume if all windows fit), charge (always
+//	                consume, negative costs refund units already consumed, never
+//	                more than the window's full budget) or peek (never consume)
+//	ARGV[4+3(i-1)]  limit, period in ms and burst of window i
+//
+// They return {allowed, tripped window (1-based, 0 if allowed)} followed by
+// {remaining, reset_ms, retry_ms, bonus} for every window; remaining includes
+// the bonus.
+//
+// Each algorithm defines check(key, limit, period, burst), which must not
+// consume budget, and commit(s, i), which does. Both use the global cost.
+const luaPrelude = `
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local cost = tonumber(ARGV[2])
+local mode = ARGV[3]
+local argBase = 3
+`
+
+const luaDriver = `
+local n = #KEYS / 2
+local allowed, tripped = 1, 0
+local states = {}
+for i = 1, n do
+  local o = argBase + 3 * (i - 1)
+  local s = check(KEYS[i], tonumber(ARGV[o + 1]), tonumber(ARGV[o + 2]), tonumber(ARGV[o + 3]))
+  s.bonus = tonumber(redis.call('GET', KEYS[n + i]) or '0')
+  if not s.ok and cost > 0 and s.bonus >= cost then
+    s.ok, s.fromBonus, s.retry = true, true, 0
+  end
+  states[i] = s
+  if allowed == 1 and not s.ok then
+    allowed, tripped = 0, i
+  end
+end
+
+local out = {allowed, tripped}
+for i = 1, n do
+  local s = states[i]
+  if mode == 'charge' or (mode == 'check' and allowed == 1) then
+    if s.fromBonus then
+      s.bonus = redis.call('DECRBY', KEYS[n + i], cost)
+    else
+      commit(s, i)
+    end
+  end
+  out[#out + 1] = math.max(0, math.floor(s.remaining)) + s.bonus
+  out[#out + 1] = math.ceil(s.reset)
+  out[#out + 1] = math.ceil(s.retry)
+  out[#out + 1] = s.bonus
+end
+return out
+`
+
+// Sliding log: one sorted set member per consumed unit, scored by its time
+const slidingLogLua = `
+local function check(key, limit, period, burst)
+  redis.call('ZREMRANGEBYSCORE', key, '-inf', now - period)
+  local count = redis.call('ZCARD', key)
+  local s = {key = key, period = period, ok = count + cost <= limit, remaining = limit - count, reset = period, retry = 0}
+  local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+  if oldest[2] then
+    s.reset = tonumber(oldest[2]) + period - now
+  end
+  if not s.ok then
+    s.retry = s.reset
+  end
+  return s
+end
+
+local function commit(s, i)
+  for j = 1, cost do
+    redis.call('ZADD', s.key, now, now .. ':' .. ARGV[1] .. ':' .. i .. ':' .. j)
+  end
+  local n = cost
+  if cost < 0 then
+    -- Refunds can only remove units that were consumed
+    n = -#redis.call('ZPOPMIN', s.key, -cost) / 2
+  end
+  redis.call('PEXPIRE', s.key, s.period)
+  s.remaining = s.remaining - n
+end
+`
+
+// Fixed window: a counter that expires at the end of the current window
+const fixedWindowLua = `
+local function check(key, limit, period, burst)
+  local count = tonumber(redis.call('GET', key) or '0')
+  local ttl = redis.call('PTTL', key)
+  if ttl < 0 then
+    ttl = period - (now % period)
+  end
+  local s = {key = key, count = count, ok = count + cost <= limit, remaining = limit - count, reset = ttl, retry = 0}
+  if not s.ok then
+    s.retry = ttl
+  end
+  return s
+end
+
+local function commit(s, i)
+  -- Refunds never take the count below zero
+  local n = math.max(-s.count, cost)
+  redis.call('INCRBY', s.key, n)
+  redis.call('PEXPIRE', s.key, s.reset)
+  s.remaining = s.remaining - n
+end
+`
+
+// Sliding window counter: the previous window's count is weighted by how much
+// of it still overlaps the sliding window
+const slidingWindowLua = `
+local function check(key, limit, period, burst)
+  local window = math.floor(now / period)
+  local state = redis.call('HMGET', key, 'w', 'c', 'p')
+  local w = tonumber(state[1]) or window
+  local cur = tonumber(state[2]) or 0
+  local prev = tonumber(state[3]) or 0
+  if w == window - 1 then
+    prev = cur
+    cur = 0
+  elseif w < window - 1 then
+    prev = 0
+    cur = 0
+  end
+
+  local elapsed = now - window * period
+  local estimated = prev * (period - elapsed) / period + cur
+  local s = {key = key, period = period, window = window, cur = cur, prev = prev,
+             ok = estimated + cost <= limit, remaining = limit - estimated, reset = period - elapsed, retry = 0}
+  if not s.ok then
+    s.retry = s.reset
+    if prev > 0 and limit - cur - cost >= 0 then
+      s.retry = math.max(1, period - (limit - cur - cost) * period / prev - elapsed)
+    end
+  end
+  return s
+end
+
+local function commit(s, i)
+  -- Refunds only give back units of the current window
+  local n = math.max(-s.cur, cost)
+  redis.call('HSET', s.key, 'w', s.window, 'c', s.cur + n, 'p', s.prev)
+  redis.call('PEXPIRE', s.key, 2 * s.period)
+  s.remaining = s.remaining - n
+end
+`
+
+// Token bucket: burst tokens, refilled at limit/period
+const tokenBucketLua = `
+local function check(key, limit, period, burst)
+  local rate = limit / period
+  local state = redis.call('HMGET', key, 't', 'ts')
+  local tokens = tonumber(state[1]) or burst
+  local ts = tonumber(state[2]) or now
+  tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+  local s = {key = key, rate = rate, capacity = burst, tokens = tokens,
+             ok = tokens >= cost, remaining = tokens, reset = (burst - tokens) / rate, retry = 0}
+  if not s.ok then
+    s.retry = (cost - tokens) / rate
+  end
+  return s
+end
+
+local function commit(s, i)
+  s.tokens = math.min(s.capacity, s.tokens - cost)
+  redis.call('HSET', s.key, 't', tostring(s.tokens), 'ts', now)
+  redis.call('PEXPIRE', s.key, math.ceil(s.capacity / s.rate))
+  s.remaining = s.tokens
+  s.reset = (s.capacity - s.tokens) / s.rate
+end
+`
+
+// GCRA: stores the theoretical arrival time (TAT) of the next request
+const gcraLua = `
+local function check(key, limit, period, burst)
+  local emission = period / limit
+  local tolerance = emission * burst
+  local tat = math.max(tonumber(redis.call('GET', key) or '0'), now)
+  local newTat = tat + emission * cost
+  local allowAt = newTat - tolerance
+
+  local s = {key = key, emission = emission, tolerance = tolerance, newTat = newTat,
+             ok = allowAt <= now, remaining = (tolerance - (tat - now)) / emission, reset = tat - now, retry = 0}
+  if not s.ok then
+    s.remaining = 0
+    s.retry = allowAt - now
+  end
+  return s
+end
+
+local function commit(s, i)
+  s.newTat = math.max(s.newTat, now)
+  if s.newTat > now then
+    redis.call('SET', s.key, tostring(s.newTat), 'PX', math.ceil(s.newTat - now))
+  else
+    redis.call('DEL', s.key)
+  end
+  s.remaining = (s.tolerance - (s.newTat - now)) / s.emission
+  s.reset = s.newTat - now
+end
+`
+
+var rateLimitScripts = map[string]*redis.Script{
+	algorithmSlidingLog:    redis.NewScript(luaPrelude + slidingLogLua + luaDriver),
+	algorithmFixedWindow:   redis.NewScript(luaPrelude + fixedWindowLua + luaDriver),
+	algorithmSlidingWindow: redis.NewScript(luaPrelude + slidingWindowLua + luaDriver),
+	algorithmTokenBucket:   redis.NewScript(luaPrelude + tokenBucketLua + luaDriver),
+	algorithmGCRA:          redis.NewScript(luaPrelude + gcraLua + luaDriver),
+}
+
+// quotaRule is a limit per period. Burst only applies to token-bucket and gcra
+// and defaults to the limit.
+type quotaRule struct {
+	Limit  int64
+	Period time.Duration
+	Burst  int64
+}
+
+// burst is the bucket size of token-bucket and gcra, the limit unless set
+func (rule quotaRule) burst() int64 {
+	if rule.Burst <= 0 {
+		return rule.Limit
+	}
+	return rule.Burst
+}
+
+// capacity is the largest cost a single request can have and still fit the
+// window when it is unused
+func (rule quotaRule) capacity(algorithm string) int64 {
+	switch algorithm {
+	case algorithmTokenBucket, algorithmGCRA:
+		return rule.burst()
+	default:
+		return rule.Limit
+	}
+}
+
+// limitResult is the state of one quota window after a check
+type limitResult struct {
+	Limit      int64
+	Period     time.Duration
+	Remaining  int64
+	ResetAfter time.Duration // until the window frees up budget again
+	RetryAfter time.Duration // until the window would accept the request
+	Bonus      int64         // granted units left on top of the limit, included in Remaining
+}
+
+// quotaDecision is the outcome of checking all windows of a quota
+type quotaDecision struct {
+	Allowed bool
+	Tripped int // index of the window that rejected the request, -1 if allowed
+	Windows []limitResult
+}
+
+// rateLimiter runs one of the algorithms as a single atomic script (EVALSHA,
+// falling back to EVAL when the script is not cached yet)
+type rateLimiter struct {
+	algorithm string
+	script    *redis.Script
+	rdb       redis.UniversalClient
+}
+
+func newRateLimiter(algorithm string, rdb redis.UniversalClient) (*rateLimiter, error) {
+	if algorithm == "" {
+		algorithm = algorithmSlidingLog
+	}
+	script, ok := rateLimitScripts[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown quota algorithm '%s'", algorithm)
+	}
+	return &rateLimiter{algorithm: algorithm, script: script, rdb: rdb}, nil
+}
+
+// Allow consumes cost units from every window if all of them have budget left.
+// keys[i] holds the state of rules[i].
+func (l *rateLimiter) Allow(ctx context.Context, keys []string, rules []quotaRule, cost int64) (quotaDecision, error) {
+	return l.run(ctx, keys, rules, cost, "check")
+}
+
+// Charge consumes cost units from every window even if that exceeds the quota,
+// for costs that are only known once the request has been served. A negative
+// cost gives units back.
+func (l *rateLimiter) Charge(ctx context.Context, keys []string, rules []quotaRule, cost int64) (quotaDecision, error) {
+	return l.run(ctx, keys, rules, cost, "charge")
+}
+
+// Peek reports whether a request of the given cost would be allowed, without
+// consuming anything
+func (l *rateLimiter) Peek(ctx context.Context, keys []string, rules []quotaRule, cost int64) (quotaDecision, error) {
+	return l.run(ctx, keys, rules, cost, "peek")
+}
+
+func (l *rateLimiter) run(ctx context.Context, keys []string, rules []quotaRule, cost int64, mode string) (quotaDecision, error) {
+	args := make([]interface{}, 0, 3+3*len(rules))
+	args = append(args, requestToken(), cost, mode)
+	for _, rule := range rules {
+		args = append(args, rule.Limit, rule.Period.Milliseconds(), rule.burst())
+	}
+
+	scriptKeys := append(slices.Clone(keys), quotaBonusKeys(keys)...)
+	res, err := l.script.Run(ctx, l.rdb, scriptKeys, args...).Int64Slice()
+	if err != nil {
+		return quotaDecision{}, err
+	}
+	if len(res) != 2+4*len(rules) {
+		return quotaDecision{}, fmt.Errorf("unexpected %s script result: %v", l.algorithm, res)
+	}
+
+	decision := quotaDecision{
+		Allowed: res[0] == 1,
+		Tripped: int(res[1]) - 1,
+		Windows: make([]limitResult, len(rules)),
+	}
+	for i, rule := range rules {
+		o := 2 + 4*i
+		decision.Windows[i] = limitResult{
+			Limit:      rule.Limit,
+			Period:     rule.Period,
+			Remaining:  res[o],
+			ResetAfter: time.Duration(res[o+1]) * time.Millisecond,
+			RetryAfter: time.Duration(res[o+2]) * time.Millisecond,
+			Bonus:      res[o+3],
+		}
+	}
+	return decision, nil
+}
+
+// requestToken returns a random ID that keeps sliding log members unique, even
+// for concurrent requests within the same millisecond
+func requestToken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
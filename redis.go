@@ -2,27 +2,165 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/redis/go-redis/v9"
-	"log"
+	"log/slog"
+	"os"
+	"time"
+)
+
+const (
+	redisModeStandalone = "standalone"
+	redisModeSentinel   = "sentinel"
+	redisModeCluster    = "cluster"
 )
 
 type RedisConfig struct {
-	Address  string `yaml:"address"`
-	Password string `yaml:"password"`
-	DB       int    `yaml:"db"`
+	Mode             string         `yaml:"mode"`      // standalone (default), sentinel or cluster
+	Address          string         `yaml:"address"`   // standalone
+	Addresses        []string       `yaml:"addresses"` // sentinel or cluster nodes
+	MasterName       string         `yaml:"masterName"`
+	Username         string         `yaml:"username"` // ACL user
+	Password         string         `yaml:"password"`
+	SentinelUsername string         `yaml:"sentinelUsername"`
+	SentinelPassword string         `yaml:"sentinelPassword"`
+	DB               int            `yaml:"db"` // not supported by cluster
+	TLS              RedisTLSConfig `yaml:"tls"`
+	PoolSize         int            `yaml:"poolSize"`     // per node, defaults to 10 per CPU
+	MinIdleConns     int            `yaml:"minIdleConns"` // per node
+	DialTimeout      string         `yaml:"dialTimeout"`  // default 5s
+	ReadTimeout      string         `yaml:"readTimeout"`  // default 3s
+	WriteTimeout     string         `yaml:"writeTimeout"` // defaults to readTimeout
+	PoolTimeout      string         `yaml:"poolTimeout"`  // defaults to readTimeout + 1s
 }
 
-func NewRedisClient(cfg RedisConfig) (*redis.Client, error) {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     cfg.Address,
-		Password: cfg.Password,
-		DB:       cfg.DB,
-	})
+type RedisTLSConfig struct {
+	Enabled            bool   `yaml:"enabled"`
+	CAFile             string `yaml:"caFile"`   // defaults to the system roots
+	CertFile           string `yaml:"certFile"` // client certificate, if the server requires one
+	KeyFile            string `yaml:"keyFile"`
+	ServerName         string `yaml:"serverName"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+}
 
-	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+// NewRedisClient builds a standalone, sentinel or cluster client. An invalid
+// configuration returns a nil client. If Redis merely cannot be reached yet, the
+// client is returned along with the error: it connects lazily, and features
+// depending on Redis apply their failure policy until it is back.
+func NewRedisClient(cfg RedisConfig) (redis.UniversalClient, error) {
+	opts, err := redisOptions(cfg)
+	if err != nil {
 		return nil, err
 	}
 
-	log.Println("Successfully connected to Redis")
+	var rdb redis.UniversalClient
+	switch cfg.Mode {
+	case "", redisModeStandalone:
+		rdb = redis.NewClient(opts.Simple())
+	case redisModeSentinel:
+		rdb = redis.NewFailoverClient(opts.Failover())
+	case redisModeCluster:
+		rdb = redis.NewClusterClient(opts.Cluster())
+	default:
+		return nil, fmt.Errorf("unknown Redis mode '%s'", cfg.Mode)
+	}
+
+	if _, err := rdb.Ping(context.Background()).Result(); err != nil {
+		return rdb, err
+	}
+
+	slog.Info("Connected to Redis", "addresses", opts.Addrs)
 	return rdb, nil
 }
+
+func redisOptions(cfg RedisConfig) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Addresses,
+		MasterName:       cfg.MasterName,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelUsername: cfg.SentinelUsername,
+		SentinelPassword: cfg.SentinelPassword,
+		DB:               cfg.DB,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+	}
+
+	switch cfg.Mode {
+	case "", redisModeStandalone:
+		if cfg.Address != "" {
+			opts.Addrs = []string{cfg.Address}
+		}
+		if len(opts.Addrs) != 1 {
+			return nil, errors.New("standalone Redis needs exactly one address")
+		}
+	case redisModeSentinel:
+		if cfg.MasterName == "" || len(cfg.Addresses) == 0 {
+			return nil, errors.New("sentinel Redis needs masterName and the sentinel addresses")
+		}
+	case redisModeCluster:
+		if len(cfg.Addresses) == 0 {
+			return nil, errors.New("cluster Redis needs at least one node address")
+		}
+		if cfg.DB != 0 {
+			return nil, errors.New("cluster Redis only has database 0")
+		}
+	}
+
+	var err error
+	timeouts := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"dialTimeout", cfg.DialTimeout, &opts.DialTimeout},
+		{"readTimeout", cfg.ReadTimeout, &opts.ReadTimeout},
+		{"writeTimeout", cfg.WriteTimeout, &opts.WriteTimeout},
+		{"poolTimeout", cfg.PoolTimeout, &opts.PoolTimeout},
+	}
+	for _, t := range timeouts {
+		// zero leaves the go-redis default in place
+		if *t.dst, err = parseDurationOr(t.value, 0); err != nil {
+			return nil, fmt.Errorf("invalid Redis %s: %w", t.name, err)
+		}
+	}
+
+	if cfg.TLS.Enabled {
+		if opts.TLSConfig, err = redisTLSConfig(cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+	return opts, nil
+}
+
+func redisTLSConfig(cfg RedisTLSConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read Redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("Redis CA file contains no valid certificates")
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load Redis client certificate: %w", err)
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+	return tlsCfg, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+const requestIDKey contextKey = "requestID"
+
+const (
+	defaultRequestIDHeader = "X-Request-Id"
+	maxRequestIDLength     = 128
+
+	trustRequestIDProxies = "proxies"
+	trustRequestIDAlways  = "always"
+	trustRequestIDNever   = "never"
+)
+
+// RequestIDConfig controls the ID that ties gateway logs, error bodies and
+// backend logs together. The ID is sent to the backend and echoed to the client
+// in the same header.
+type RequestIDConfig struct {
+	Header string `yaml:"header"` // default X-Request-Id
+	// TrustIncoming decides when an ID sent with the request is kept: proxies
+	// (default) only if the connection comes from a trusted proxy, always or never
+	TrustIncoming string `yaml:"trustIncoming"`
+}
+
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// requestIDFrom returns the ID of the request, or "" outside of one
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID rejects incoming IDs that could break log lines or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDMiddleware assigns every request its ID before anything else runs,
+// so per-IP rejections and unknown paths have one too. The default logger of
+// the request carries it as request_id.
+func requestIDMiddleware(next http.Handler, cfg RequestIDConfig, ips *ipResolver) (http.Handler, error) {
+	header := cfg.Header
+	if header == "" {
+		header = defaultRequestIDHeader
+	}
+	trust := cfg.TrustIncoming
+	switch trust {
+	case "":
+		trust = trustRequestIDProxies
+	case trustRequestIDProxies, trustRequestIDAlways, trustRequestIDNever:
+	default:
+		return nil, fmt.Errorf("unknown trustIncoming mode '%s'", cfg.TrustIncoming)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(header)
+		if !validRequestID(id) || !trustsIncomingID(r, trust, ips) {
+			id = newRequestID()
+		}
+		// The reverse proxy copies the request headers, so the backend sees the same ID
+		r.Header.Set(header, id)
+		w.Header().Set(header, id)
+		if rec := accessRecordFrom(r.Context()); rec != nil {
+			rec.requestID = id
+		}
+
+		ctx := withRequestID(r.Context(), id)
+		ctx = withLogger(ctx, slog.Default().With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}), nil
+}
+
+func trustsIncomingID(r *http.Request, trust string, ips *ipResolver) bool {
+	switch trust {
+	case trustRequestIDAlways:
+		return true
+	case trustRequestIDNever:
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	return remote != nil && ips.isTrusted(remote)
+}
+
+// httpError is http.Error with the request ID appended, so clients can quote
+// it when reporting a problem
+func httpError(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := requestIDFrom(r.Context()); id != "" {
+		msg += " (request ID " + id + ")"
+	}
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redis layout:
+//
+//	revoked:jti  -> ZSET of revoked token IDs scored by the token's exp (unix seconds)
+//	revoked:sub  -> HASH of subject -> "revoked before" timestamp (unix seconds)
+//	revocations  -> pub/sub channel announcing new entries ("jti:<id>" or "sub:<id>:<ts>")
+const (
+	revokedJTIKey      = "revoked:jti"
+	revokedSubjectKey  = "revoked:sub"
+	revocationsChannel = "revocations"
+)
+
+type RevocationConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	RefreshInterval string `yaml:"refreshInterval"` // full resync from Redis, e.g. "30s"
+}
+
+// revocationList keeps an in-process copy of the revocation state. Revoked token
+// IDs are held in a bloom filter, so only tokens that hit the filter cost a Redis
+// round trip; revoked subjects are few and kept in a map.
+type revocationList struct {
+	rdb     redis.UniversalClient
+	started sync.Once
+
+	mu       sync.RWMutex
+	jtis     *bloomFilter
+	subjects map[string]int64 // subject -> revoked before (unix seconds)
+}
+
+func newRevocationList(rdb redis.UniversalClient) *revocationList {
+	return &revocationList{
+		rdb:      rdb,
+		jtis:     newBloomFilter(1024, 0.01),
+		subjects: make(map[string]int64),
+	}
+}
+
+// start keeps the local copy in sync, both by periodic refresh and by listening
+// for revocations announced by other gateway instances. Only the first call
+// starts anything.
+func (rl *revocationList) start(interval time.Duration) {
+	rl.started.Do(func() { rl.sync(interval) })
+}
+
+func (rl *revocationList) sync(interval time.Duration) {
+	go func() {
+		for {
+			if err := rl.refresh(context.Background()); err != nil {
+				slog.Warn("Failed to refresh revocation list", "error", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+
+	go func() {
+		for {
+			pubsub := rl.rdb.Subscribe(context.Background(), revocationsChannel)
+			for msg := range pubsub.Channel() {
+				rl.apply(msg.Payload)
+			}
+			pubsub.Close()
+			slog.Warn("Revocation subscription closed, resubscribing in 5s")
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func (rl *revocationList) refresh(ctx context.Context) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := rl.rdb.ZRemRangeByScore(ctx, revokedJTIKey, "-inf", now).Err(); err != nil {
+		return fmt.Errorf("failed to purge expired revocations: %w", err)
+	}
+	jtis, err := rl.rdb.ZRange(ctx, revokedJTIKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load revoked tokens: %w", err)
+	}
+	subjects, err := rl.rdb.HGetAll(ctx, revokedSubjectKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to load revoked subjects: %w", err)
+	}
+
+	// Leave room for tokens revoked before the next refresh
+	filter := newBloomFilter(max(2*len(jtis), 1024), 0.01)
+	for _, jti := range jtis {
+		filter.Add(jti)
+	}
+	subjectMap := make(map[string]int64, len(subjects))
+	for sub, ts := range subjects {
+		before, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			slog.Warn("Ignoring invalid revocation timestamp", "sub", sub, "timestamp", ts)
+			continue
+		}
+		subjectMap[sub] = before
+	}
+
+	rl.mu.Lock()
+	rl.jtis = filter
+	rl.subjects = subjectMap
+	rl.mu.Unlock()
+	return nil
+}
+
+// apply records a revocation announced on the pub/sub channel
+func (rl *revocationList) apply(payload string) {
+	kind, value, _ := strings.Cut(payload, ":")
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	switch kind {
+	case "jti":
+		rl.jtis.Add(value)
+	case "sub":
+		idx := strings.LastIndex(value, ":")
+		if idx < 0 {
+			return
+		}
+		before, err := strconv.ParseInt(value[idx+1:], 10, 64)
+		if err != nil {
+			return
+		}
+		if before == 0 {
+			delete(rl.subjects, value[:idx])
+		} else {
+			rl.subjects[value[:idx]] = before
+		}
+	}
+}
+
+// IsRevoked reports whether a token with the given ID, subject and issue time has been revoked
+func (rl *revocationList) IsRevoked(ctx context.Context, jti, subject string, issuedAt time.Time) (bool, error) {
+	rl.mu.RLock()
+	before, subjectRevoked := rl.subjects[subject]
+	mayContain := jti != "" && rl.jtis.MayContain(jti)
+	rl.mu.RUnlock()
+
+	// Tokens without iat cannot prove they were issued after the cut-off
+	if subjectRevoked && (issuedAt.IsZero() || issuedAt.Unix() <= before) {
+		return true, nil
+	}
+	if !mayContain {
+		return false, nil
+	}
+
+	_, err := rl.rdb.ZScore(ctx, revokedJTIKey, jti).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+	return true, nil
+}
+
+// RevokeToken revokes a single token until its expiry
+func (rl *revocationList) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if err := rl.rdb.ZAdd(ctx, revokedJTIKey, redis.Z{Score: float64(expiresAt.Unix()), Member: jti}).Err(); err != nil {
+		return err
+	}
+	rl.apply("jti:" + jti)
+	return rl.rdb.Publish(ctx, revocationsChannel, "jti:"+jti).Err()
+}
+
+// RevokeSubject revokes every token of a subject issued at or before the given time.
+// A zero time lifts the revocation.
+func (rl *revocationList) RevokeSubject(ctx context.Context, subject string, before time.Time) error {
+	var err error
+	var ts int64
+	if before.IsZero() {
+		err = rl.rdb.HDel(ctx, revokedSubjectKey, subject).Err()
+	} else {
+		ts = before.Unix()
+		err = rl.rdb.HSet(ctx, revokedSubjectKey, subject, ts).Err()
+	}
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("sub:%s:%d", subject, ts)
+	rl.apply(msg)
+	return rl.rdb.Publish(ctx, revocationsChannel, msg).Err()
+}
+
+// RevokedSubjects returns a copy of the locally known subject revocations
+func (rl *revocationList) RevokedSubjects() map[string]int64 {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+
+	subjects := make(map[string]int64, len(rl.subjects))
+	for sub, before := range rl.subjects {
+		subjects[sub] = before
+	}
+	return subjects
+}
+
+// bloomFilter is a fixed size bloom filter using double hashing
+type bloomFilter struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint64 // number of hash functions
+}
+
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Max(1, math.Round(float64(m)/float64(capacity)*math.Ln2)))
+	return &bloomFilter{
+		bits: make([]uint64, (m+63)/64),
+		m:    m,
+		k:    k,
+	}
+}
+
+func (b *bloomFilter) hashes(s string) (uint64, uint64) {
+	ha := fnv.New64a()
+	ha.Write([]byte(s))
+	hb := fnv.New64()
+	hb.Write([]byte(s))
+	return ha.Sum64(), hb.Sum64() | 1
+}
+
+func (b *bloomFilter) Add(s string) {
+	h1, h2 := b.hashes(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (b *bloomFilter) MayContain(s string) bool {
+	h1, h2 := b.hashes(s)
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
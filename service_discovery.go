@@ -3,12 +3,12 @@ package main
 import (
 	"fmt"
 	"github.com/hashicorp/consul/api"
-	"log"
+	"log/slog"
 	"time"
 )
 
 func (s *ServerPool) startConsulWatcher(client *api.Client, serviceName string) {
-	log.Printf("Starting Consul watcher for service: %s", serviceName)
+	slog.Info("Starting Consul watcher", "consul_service", serviceName)
 	var lastIndex uint64 = 0
 
 	go func() {
@@ -20,13 +20,14 @@ func (s *ServerPool) startConsulWatcher(client *api.Client, serviceName string)
 			// a.k.a "What's the current list of healthy {serviceName} backends?"
 			services, meta, err := client.Health().Service(serviceName, "", true, opts)
 			if err != nil {
-				log.Printf("Error watching Consul service %s: %v. Retrying in 5s...", serviceName, err)
+				slog.Error("Error watching Consul service, retrying in 5s", "consul_service", serviceName, "error", err)
 				time.Sleep(5 * time.Second)
 				continue
 			}
 
 			lastIndex = meta.LastIndex
-			log.Printf("Consul update for %s. New index: %d. Found %d instances.", serviceName, lastIndex, len(services))
+			consulLastSuccess.WithLabelValues("service", serviceName).SetToCurrentTime()
+			slog.Debug("Consul update", "consul_service", serviceName, "index", lastIndex, "instances", len(services))
 
 			newBackendSet := make(map[string]bool)
 			for _, entry := range services {
@@ -46,7 +47,7 @@ func (s *ServerPool) startConsulWatcher(client *api.Client, serviceName string)
 					serviceURL := fmt.Sprintf("http://%s:%d", addr, port)
 
 					if err := s.AddBackend(serviceID, serviceURL); err != nil {
-						log.Printf("Failed to add backend %s: %v", serviceID, err)
+						slog.Error("Failed to add backend", "id", serviceID, "error", err)
 					}
 				} else {
 					// It exists, make sure it's marked as alive (in case our proxy marked it down)
@@ -61,6 +62,7 @@ func (s *ServerPool) startConsulWatcher(client *api.Client, serviceName string)
 				}
 			}
 			s.mu.RUnlock()
+			s.synced.Store(true)
 		}
 	}()
 }
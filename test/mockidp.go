@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// A minimal OpenID Connect provider for testing the gateway's OIDC login flow.
+// Every authorization request is approved immediately for the configured user
+// (or the user given in the login_hint parameter).
+//
+// How to run:
+// go run test/mockidp.go -port 9999 -client-id hexgate -client-secret secret
+// Then point a service's oidc.issuer at http://localhost:9999
+
+type authCode struct {
+	subject     string
+	nonce       string
+	challenge   string
+	redirectURI string
+}
+
+func main() {
+	port := flag.Int("port", 9999, "Port to listen on")
+	issuer := flag.String("issuer", "", "Issuer URL (defaults to http://localhost:<port>)")
+	clientID := flag.String("client-id", "hexgate", "Accepted client ID")
+	clientSecret := flag.String("client-secret", "", "Client secret; empty accepts public clients")
+	user := flag.String("user", "alice", "Subject of the logged in user")
+	ttl := flag.Duration("ttl", 5*time.Minute, "ID token lifetime (keep it short to exercise refreshes)")
+	flag.Parse()
+
+	if *issuer == "" {
+		*issuer = "http://localhost:" + strconv.Itoa(*port)
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatalf("Failed to generate signing key: %v", err)
+	}
+	const kid = "mock-key-1"
+
+	var mu sync.Mutex
+	codes := make(map[string]authCode)
+	refreshTokens := make(map[string]string) // refresh token -> subject
+
+	issueIDToken := func(subject, nonce string) (string, error) {
+		now := time.Now()
+		claims := jwt.MapClaims{
+			"iss":   *issuer,
+			"sub":   subject,
+			"aud":   *clientID,
+			"iat":   now.Unix(),
+			"exp":   now.Add(*ttl).Unix(),
+			"name":  subject,
+			"email": subject + "@example.com",
+		}
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		return token.SignedString(key)
+	}
+
+	writeJSON := func(w http.ResponseWriter, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+	}
+
+	http.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"issuer":                                *issuer,
+			"authorization_endpoint":                *issuer + "/authorize",
+			"token_endpoint":                        *issuer + "/token",
+			"jwks_uri":                              *issuer + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+			"code_challenge_methods_supported":      []string{"S256"},
+		})
+	})
+
+	http.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"use": "sig",
+				"alg": "RS256",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	http.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("client_id") != *clientID || q.Get("redirect_uri") == "" {
+			http.Error(w, "invalid client_id or redirect_uri", http.StatusBadRequest)
+			return
+		}
+		if q.Get("code_challenge_method") != "S256" {
+			http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+			return
+		}
+
+		subject := *user
+		if hint := q.Get("login_hint"); hint != "" {
+			subject = hint
+		}
+		code := randomString()
+		mu.Lock()
+		codes[code] = authCode{subject: subject, nonce: q.Get("nonce"), challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri")}
+		mu.Unlock()
+
+		target, err := url.Parse(q.Get("redirect_uri"))
+		if err != nil {
+			http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+			return
+		}
+		params := target.Query()
+		params.Set("code", code)
+		params.Set("state", q.Get("state"))
+		target.RawQuery = params.Encode()
+		log.Printf("Approved login for %s, redirecting to %s", subject, target.Redacted())
+		http.Redirect(w, r, target.String(), http.StatusFound)
+	})
+
+	http.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "invalid form", http.StatusBadRequest)
+			return
+		}
+		id, secret, ok := r.BasicAuth()
+		if !ok {
+			id = r.PostForm.Get("client_id")
+		}
+		if id != *clientID || (*clientSecret != "" && secret != *clientSecret) {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+
+		var subject, nonce string
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			mu.Lock()
+			c, ok := codes[r.PostForm.Get("code")]
+			delete(codes, r.PostForm.Get("code"))
+			mu.Unlock()
+
+			sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+			if !ok || c.redirectURI != r.PostForm.Get("redirect_uri") ||
+				base64.RawURLEncoding.EncodeToString(sum[:]) != c.challenge {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			subject, nonce = c.subject, c.nonce
+		case "refresh_token":
+			mu.Lock()
+			s, ok := refreshTokens[r.PostForm.Get("refresh_token")]
+			mu.Unlock()
+			if !ok {
+				http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+				return
+			}
+			subject = s
+		default:
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+
+		idToken, err := issueIDToken(subject, nonce)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		refreshToken := randomString()
+		mu.Lock()
+		refreshTokens[refreshToken] = subject
+		mu.Unlock()
+
+		log.Printf("Issued tokens for %s (%s)", subject, r.PostForm.Get("grant_type"))
+		writeJSON(w, map[string]interface{}{
+			"access_token":  randomString(),
+			"token_type":    "Bearer",
+			"expires_in":    int(ttl.Seconds()),
+			"id_token":      idToken,
+			"refresh_token": refreshToken,
+		})
+	})
+
+	log.Printf("Mock OIDC provider %s listening on port %d", *issuer, *port)
+	if err := http.ListenAndServe(":"+strconv.Itoa(*port), nil); err != nil {
+		log.Fatalf("Mock IdP failed: %v", err)
+	}
+}
+
+func randomString() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
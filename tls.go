@@ -1,17 +1,19 @@
 package main
 
 import (
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 )
 
 type TLSConfig struct {
-	Enabled   bool   `yaml:"enabled"`
-	HTTPSPort string `yaml:"httpsPort"`
-	CertFile  string `yaml:"certFile"`
-	KeyFile   string `yaml:"keyFile"`
+	Enabled      bool   `yaml:"enabled"`
+	HTTPSPort    string `yaml:"httpsPort"`
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientAuth   string `yaml:"clientAuth"`   // "none" (default), "optional" or "require"
+	ClientCAFile string `yaml:"clientCAFile"` // CA bundle used to verify client certificates
 }
 
 // createRedirectHandler creates a handler to redirect HTTP to HTTPS
@@ -30,7 +32,7 @@ func createRedirectHandler(httpsPort string) http.HandlerFunc {
 			RawQuery: r.URL.Query().Encode(),
 		}
 
-		log.Printf("Redirecting HTTP request from %s to %s", r.RemoteAddr, targetURL.String())
+		slog.Debug("Redirecting HTTP request to HTTPS", "remote_addr", r.RemoteAddr, "target", targetURL.String())
 		http.Redirect(w, r, targetURL.String(), http.StatusMovedPermanently) // 301
 	}
 }
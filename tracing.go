@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/extra/redisotel/v9"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"os"
+	"time"
+)
+
+const stageKey contextKey = "middlewareStage"
+
+const (
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+	tracingExporterFile   = "file"
+)
+
+// TracingConfig enables OpenTelemetry tracing. Every request gets a server span
+// per service with child spans for authentication, the quota check (including
+// its Redis commands) and the upstream round trip. Incoming W3C traceparent and
+// B3 headers are honoured, and both are sent to the backends.
+type TracingConfig struct {
+	Enabled     bool   `yaml:"enabled"`
+	ServiceName string `yaml:"serviceName"` // default "hexgate"
+	Exporter    string `yaml:"exporter"`    // otlp (default), stdout or file
+	// OTLP exporter; the endpoint is host:port, e.g. "otel-collector:4317"
+	Protocol string `yaml:"protocol"` // grpc (default) or http
+	Endpoint string `yaml:"endpoint"`
+	Insecure bool   `yaml:"insecure"` // plain text instead of TLS
+	Path     string `yaml:"path"`     // file exporter, default "traces.json"
+	// SampleRatio is the fraction of new traces recorded, 0 to 1 (default 1).
+	// Requests that arrive with a sampling decision keep it.
+	SampleRatio *float64 `yaml:"sampleRatio"`
+}
+
+var tracer = otel.Tracer("hexgate")
+
+// setupTracing installs the global tracer provider and propagators. Without it
+// the OpenTelemetry defaults are no-ops, so the spans below cost next to nothing.
+func setupTracing(cfg TracingConfig, rdb redis.UniversalClient) error {
+	ratio := 1.0
+	if cfg.SampleRatio != nil {
+		ratio = *cfg.SampleRatio
+		if ratio < 0 || ratio > 1 {
+			return fmt.Errorf("sampleRatio must be between 0 and 1")
+		}
+	}
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = "hexgate"
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	}
+	switch cfg.Exporter {
+	case "", tracingExporterOTLP:
+		exporter, err := newOTLPExporter(cfg)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	case tracingExporterStdout, tracingExporterFile:
+		exporterOpts := []stdouttrace.Option{stdouttrace.WithPrettyPrint()}
+		if cfg.Exporter == tracingExporterFile {
+			path := cfg.Path
+			if path == "" {
+				path = "traces.json"
+			}
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+			if err != nil {
+				return err
+			}
+			exporterOpts = []stdouttrace.Option{stdouttrace.WithWriter(f)}
+		}
+		exporter, err := stdouttrace.New(exporterOpts...)
+		if err != nil {
+			return err
+		}
+		// Export right away, these exporters are meant for local testing
+		opts = append(opts, sdktrace.WithSyncer(exporter))
+	default:
+		return fmt.Errorf("unknown exporter '%s'", cfg.Exporter)
+	}
+
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(opts...))
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader|b3.B3SingleHeader)),
+	))
+	if rdb != nil {
+		if err := redisotel.InstrumentTracing(rdb); err != nil {
+			return fmt.Errorf("failed to instrument Redis: %w", err)
+		}
+	}
+	return nil
+}
+
+func newOTLPExporter(cfg TracingConfig) (sdktrace.SpanExporter, error) {
+	ctx := context.Background()
+	switch cfg.Protocol {
+	case "", "grpc":
+		opts := []otlptracegrpc.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http":
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol '%s'", cfg.Protocol)
+	}
+}
+
+// tracingMiddleware starts the server span of a request, continuing the trace
+// of the caller if it sent one. The trace ID is added to the request logger.
+func tracingMiddleware(next http.Handler, serviceName string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, serviceName, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("hexgate.service", serviceName),
+			attribute.String("hexgate.request_id", requestIDFrom(r.Context())),
+		))
+		defer span.End()
+		if span.SpanContext().IsSampled() {
+			ctx = withLogger(ctx, loggerFrom(ctx).With("trace_id", span.SpanContext().TraceID().String()))
+		}
+
+		rwi := newResponseWriterInterceptor(w)
+		next.ServeHTTP(rwi, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rwi.statusCode))
+		if rwi.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rwi.statusCode))
+		}
+	})
+}
+
+// middlewareStage is a stage of the middleware chain in progress: its span, the
+// span it interrupted and when it started
+type middlewareStage struct {
+	service string
+	name    string
+	start   time.Time
+	span    trace.Span
+	parent  trace.Span
+	done    bool
+}
+
+// finish ends the stage's span and records its duration
+func (st *middlewareStage) finish() {
+	if st.done {
+		return
+	}
+	st.done = true
+	st.span.End()
+	middlewareDuration.WithLabelValues(st.service, st.name).Observe(time.Since(st.start).Seconds())
+}
+
+// startStage and endStage bracket a stage of the middleware chain, e.g. all of
+// authentication, in a child span and in hexgate_middleware_duration_seconds.
+// startStage wraps the stage; endStage wraps the handler the stage calls once it
+// lets the request through, so the stage ends there instead of covering the
+// rest of the chain.
+func startStage(next http.Handler, serviceName, name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &middlewareStage{service: serviceName, name: name, start: time.Now(), parent: trace.SpanFromContext(r.Context())}
+		ctx, span := tracer.Start(r.Context(), name)
+		st.span = span
+		ctx = context.WithValue(ctx, stageKey, st)
+
+		rwi := newResponseWriterInterceptor(w)
+		next.ServeHTTP(rwi, r.WithContext(ctx))
+		if !st.done && rwi.statusCode >= http.StatusBadRequest {
+			span.SetAttributes(attribute.Int("http.response.status_code", rwi.statusCode))
+			span.SetStatus(codes.Error, http.StatusText(rwi.statusCode))
+		}
+		st.finish()
+	})
+}
+
+func endStage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st, ok := r.Context().Value(stageKey).(*middlewareStage)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		st.finish()
+		ctx := context.WithValue(r.Context(), stageKey, nil)
+		next.ServeHTTP(w, r.WithContext(trace.ContextWithSpan(ctx, st.parent)))
+	})
+}